@@ -0,0 +1,235 @@
+package bench
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"bench/isubank"
+	"github.com/pkg/errors"
+)
+
+// BankCheck は isubank のロックの正しさを確認します
+// BankCheckUsers 人の間で送金(送り手の -x と受け手の +x の予約)を BankCheckWorkers 並列で作り、
+// 2つの予約を順番をばらばらにしてまとめて commit します。ユーザーの行ロックの順序によっては deadlock します
+// 最後に各ユーザーの残高が確定した送金の合計と一致し、全体の残高が増減していないことを確認します
+func (c *Manager) BankCheck(ctx context.Context) error {
+	users := make([]string, BankCheckUsers)
+	expected := make(map[string]int64, BankCheckUsers)
+	for i := range users {
+		users[i] = c.FetchNewID()
+		if err := c.isubank.AddCredit(users[i], BankCheckCredit); err != nil {
+			return errors.Wrap(err, "isubank add credit failed")
+		}
+		expected[users[i]] = BankCheckCredit
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		errs      []error
+		committed int
+	)
+	for i := 0; i < BankCheckWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < BankCheckTransfers; j++ {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				from := users[c.rng.Intn(len(users))]
+				to := users[c.rng.Intn(len(users))]
+				if from == to {
+					continue
+				}
+				amount := c.rng.Int63n(100) + 1
+				rfrom, err := c.isubank.Reserve(from, -amount)
+				if err != nil {
+					log.Printf("[INFO] bank check reserve failed. %s", err)
+					continue
+				}
+				rto, err := c.isubank.Reserve(to, amount)
+				if err != nil {
+					log.Printf("[INFO] bank check reserve failed. %s", err)
+					// 片方だけの予約を残すと expected とずれるので取り消す
+					if err := c.isubank.Cancel([]int64{rfrom}); err != nil {
+						log.Printf("[INFO] bank check cancel failed. %s", err)
+					}
+					continue
+				}
+				ids := []int64{rfrom, rto}
+				if c.rng.Intn(2) == 0 {
+					ids[0], ids[1] = ids[1], ids[0]
+				}
+				err = c.isubank.Commit(ids)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					expected[from] -= amount
+					expected[to] += amount
+					committed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errors.Errorf("commit に %d 回失敗しました (最初のエラー: %s)", len(errs), errs[0])
+	}
+	var total int64
+	for _, u := range users {
+		credit, err := c.isubank.GetCredit(u)
+		if err != nil {
+			return err
+		}
+		if credit != expected[u] {
+			return errors.Errorf("残高が一致しません [bank_id:%s, credit:%d, expected:%d]", u, credit, expected[u])
+		}
+		total += credit
+	}
+	if total != BankCheckCredit*BankCheckUsers {
+		return errors.Errorf("残高の合計が一致しません [total:%d, expected:%d]", total, BankCheckCredit*BankCheckUsers)
+	}
+	c.Logger().Printf("bank check: %d 件の送金を確定しました", committed)
+	return nil
+}
+
+// BankExpiryCheck は予約の期限が守られているかを確認します
+// 同時に2つの予約を作り、銀行の時刻(/time)で期限の BankCheckExpiryMargin 前に1つ目を commit して成功すること、
+// 期限を過ぎてから2つ目を commit して reserve_expired になりお金が動かないことを確認します
+// 銀行の -reserve-ttl だけ時間がかかります
+func (c *Manager) BankExpiryCheck(ctx context.Context) error {
+	const credit, price = 1000, 100
+	bankid := c.FetchNewID()
+	if err := c.isubank.AddCredit(bankid, credit); err != nil {
+		return errors.Wrap(err, "isubank add credit failed")
+	}
+	control, expire, err := c.isubank.ReserveWithExpiry(bankid, -price)
+	if err != nil {
+		return err
+	}
+	expired, _, err := c.isubank.ReserveWithExpiry(bankid, -price)
+	if err != nil {
+		return err
+	}
+	now, err := c.isubank.Time()
+	if err != nil {
+		return err
+	}
+	c.Logger().Printf("bank check: 予約の期限 %s まで %s 待ちます", expire.Format(time.RFC3339), expire.Sub(now))
+
+	wait := func(d time.Duration) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			return nil
+		}
+	}
+	if err := wait(expire.Add(-BankCheckExpiryMargin).Sub(now)); err != nil {
+		return err
+	}
+	if err := c.isubank.Commit([]int64{control}); err != nil {
+		return errors.Wrap(err, "期限前の commit に失敗しました")
+	}
+
+	// expire_at は秒の精度で保存されるので1秒余分に待つ
+	if now, err = c.isubank.Time(); err != nil {
+		return err
+	}
+	if err := wait(expire.Add(time.Second + BankCheckExpiryMargin).Sub(now)); err != nil {
+		return err
+	}
+	err = c.isubank.Commit([]int64{expired})
+	if err == nil {
+		return errors.Errorf("期限切れの予約の commit に成功しました [reserve_id:%d]", expired)
+	}
+	if errors.Cause(err) != isubank.ErrReserveExpired {
+		return errors.Wrap(err, "期限切れの予約の commit が reserve_expired になりませんでした")
+	}
+
+	got, err := c.isubank.GetCredit(bankid)
+	if err != nil {
+		return err
+	}
+	if got != credit-price {
+		return errors.Errorf("残高が一致しません [bank_id:%s, credit:%d, expected:%d]", bankid, got, credit-price)
+	}
+	c.Logger().Printf("bank check: 予約の期限を確認しました")
+	return nil
+}
+
+// BankAbandonCheck は commit も cancel もされずに放置された予約が期限で無効になるかを確認します
+// 残高の 6 割の is_minus の予約を放置し、期限内は同じ額の予約が credit_insufficient になること、
+// 期限を過ぎると is_minus の集計から外れて同じ額の予約ができることを確認します
+// gc の場合はさらに銀行の -gc-interval で予約が削除される (reserve_status が not_found になる) まで待ちます
+func (c *Manager) BankAbandonCheck(ctx context.Context, gc bool) error {
+	const credit, price = 1000, 600
+	bankid := c.FetchNewID()
+	if err := c.isubank.AddCredit(bankid, credit); err != nil {
+		return errors.Wrap(err, "isubank add credit failed")
+	}
+	abandoned, expire, err := c.isubank.ReserveWithExpiry(bankid, -price)
+	if err != nil {
+		return err
+	}
+	reservedAt, err := c.isubank.Time()
+	if err != nil {
+		return err
+	}
+	if _, err := c.isubank.Reserve(bankid, -price); err == nil {
+		return errors.Errorf("放置された予約の分の残高が使えてしまいました [reserve_id:%d]", abandoned)
+	} else if errors.Cause(err) != isubank.ErrCreditInsufficient {
+		return errors.Wrap(err, "期限内の予約を超える予約が credit_insufficient になりませんでした")
+	}
+
+	wait := func(d time.Duration) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			return nil
+		}
+	}
+	// expire_at は秒の精度で保存されるので1秒余分に待つ
+	if err := wait(expire.Add(time.Second + BankCheckExpiryMargin).Sub(reservedAt)); err != nil {
+		return err
+	}
+	probe, err := c.isubank.Reserve(bankid, -price)
+	if err != nil {
+		return errors.Wrap(err, "期限切れの予約の分の残高が戻りませんでした")
+	}
+	if err := c.isubank.Cancel([]int64{probe}); err != nil {
+		return err
+	}
+	c.Logger().Printf("bank check: 放置された予約の期限で残高が戻ることを確認しました")
+	if !gc {
+		return nil
+	}
+
+	// 銀行は期限から -reserve-ttl 経った予約を削除する
+	ttl := expire.Sub(reservedAt)
+	deadline := time.Now().Add(ttl + BankCheckGCWait)
+	c.Logger().Printf("bank check: 放置された予約が削除されるまで最大 %s 待ちます", deadline.Sub(time.Now()))
+	for time.Now().Before(deadline) {
+		status, err := c.isubank.ReserveStatus([]int64{abandoned})
+		if err != nil {
+			return err
+		}
+		if status[abandoned] == "not_found" {
+			c.Logger().Printf("bank check: 放置された予約が削除されたことを確認しました")
+			return nil
+		}
+		if err := wait(BankCheckPollInterval); err != nil {
+			return err
+		}
+	}
+	return errors.Errorf("期限切れの予約が削除されませんでした。銀行の -gc-interval を確認してください [reserve_id:%d]", abandoned)
+}
@@ -0,0 +1,73 @@
+package bench
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRequestLimit は -max-requests に達した後のリクエストで返します
+var ErrRequestLimit = errors.New("request limit is reached")
+
+// requestBudget は -max-requests の時に負荷走行中の app へのリクエスト数を数えます
+// nil の場合は制限しません
+var requestBudget *budget
+
+type budget struct {
+	max    int64
+	count  int64
+	active int32
+	done   chan struct{}
+	once   sync.Once
+}
+
+// SetMaxRequests は負荷走行中の app へのリクエストを合計 max 回までにします。0 以下の場合は制限しません
+func SetMaxRequests(max int64) {
+	if max <= 0 {
+		requestBudget = nil
+		return
+	}
+	requestBudget = &budget{
+		max:  max,
+		done: make(chan struct{}),
+	}
+}
+
+// start は負荷走行の開始から数え始めます。初期化や事前テストのリクエストは数えません
+func (b *budget) start() {
+	if b == nil {
+		return
+	}
+	atomic.StoreInt32(&b.active, 1)
+}
+
+// stop は数えるのをやめます。負荷走行後のテストのリクエストは制限しません
+func (b *budget) stop() {
+	if b == nil {
+		return
+	}
+	atomic.StoreInt32(&b.active, 0)
+}
+
+// take はリクエストを1回分使います。上限を超えていたら false を返します
+func (b *budget) take() bool {
+	if b == nil || atomic.LoadInt32(&b.active) == 0 {
+		return true
+	}
+	n := atomic.AddInt64(&b.count, 1)
+	if n >= b.max {
+		b.once.Do(func() {
+			close(b.done)
+		})
+	}
+	return n <= b.max
+}
+
+// exhausted は上限に達したら close される channel です。nil の場合は永遠に待ちます
+func (b *budget) exhausted() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.done
+}
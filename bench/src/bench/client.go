@@ -3,6 +3,8 @@ package bench
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,6 +22,7 @@ import (
 	"bench/urlcache"
 
 	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/publicsuffix"
 )
 
@@ -33,6 +36,60 @@ var (
 	ErrAlreadyRetired = errors.New("already retired client")
 )
 
+// TransportConfig は Client の transport の設定です
+type TransportConfig struct {
+	HTTP2               bool
+	MaxIdleConnsPerHost int
+	TLSVerify           bool           // false なら証明書を検証しない
+	RootCAs             *x509.CertPool // nil ならシステムの証明書を使う
+}
+
+var transportConfig = TransportConfig{
+	MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+	TLSVerify:           true,
+}
+
+// SetTransportConfig は以降に作られる Client の transport の設定を変更します
+func SetTransportConfig(cfg TransportConfig) {
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	}
+	transportConfig = cfg
+	log.Printf("[INFO] http2 %t, max idle conns per host %d, tls verify %t", cfg.HTTP2, cfg.MaxIdleConnsPerHost, cfg.TLSVerify)
+}
+
+// LoadCACert は PEM 形式の CA 証明書をシステムの証明書に追加した CertPool を返します
+func LoadCACert(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read ca cert failed")
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no certificate in %s", path)
+	}
+	return pool, nil
+}
+
+func NewTransport(cfg TransportConfig) (*http.Transport, error) {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !cfg.TLSVerify,
+			RootCAs:            cfg.RootCAs,
+		},
+	}
+	if cfg.HTTP2 {
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, errors.Wrap(err, "http2 configure transport failed")
+		}
+	}
+	return transport, nil
+}
+
 type ResponseWithElapsedTime struct {
 	*http.Response
 	ElapsedTime time.Duration
@@ -154,7 +211,10 @@ func NewClient(base, bankid, name, password string, timeout, retire time.Duratio
 	if err != nil {
 		return nil, errors.Wrapf(err, "cookiejar.New Failed.")
 	}
-	transport := &http.Transport{}
+	transport, err := NewTransport(transportConfig)
+	if err != nil {
+		return nil, err
+	}
 	hc := &http.Client{
 		Jar:       jar,
 		Transport: transport,
@@ -197,15 +257,23 @@ func (c *Client) doRequest(ctx context.Context, req *http.Request) (*ResponseWit
 	}
 	start := time.Now()
 	for {
+		if !requestBudget.take() {
+			return nil, ErrRequestLimit
+		}
 		if reqbody != nil {
 			req.Body = ioutil.NopCloser(bytes.NewBuffer(reqbody))
 		}
 		if ctx != nil {
 			req = req.WithContext(ctx)
 		}
-		res, err := c.hc.Do(req)
+		treq, rt := tracer.sample(req, reqbody, c.bankid)
+		res, err := c.hc.Do(treq)
 		if err != nil {
+			tracer.finish(rt, nil, err)
 			elapsedTime := time.Now().Sub(start)
+			requestStats.record(req, 0, elapsedTime)
+			userStats.record(c.bankid, 0, elapsedTime)
+			debugSink.capture("transport", req, reqbody, 0, nil, err)
 			if e, ok := err.(*url.Error); ok {
 				// log.Printf("[DEBUG] url.Error %#v", e)
 				if e.Timeout() && c.retireto <= elapsedTime {
@@ -224,7 +292,14 @@ func (c *Client) doRequest(ctx context.Context, req *http.Request) (*ResponseWit
 			}
 			return nil, err
 		}
+		tracer.finish(rt, res, nil)
 		elapsedTime := time.Now().Sub(start)
+		// Retry-After で待たされたものは失敗ではないので requestStats.backoff で別に数える
+		wait, backoff := retryAfter(res)
+		if !backoff {
+			requestStats.record(req, res.StatusCode, elapsedTime)
+			userStats.record(c.bankid, res.StatusCode, elapsedTime)
+		}
 		if c.retireto < elapsedTime {
 			if err = res.Body.Close(); err != nil {
 				log.Printf("[WARN] body close failed. %s", err)
@@ -235,6 +310,9 @@ func (c *Client) doRequest(ctx context.Context, req *http.Request) (*ResponseWit
 			}
 		}
 		if res.StatusCode < 500 {
+			if debugSink != nil && res.StatusCode >= 400 {
+				debugSink.capture(fmt.Sprintf("status_%d", res.StatusCode), req, reqbody, res.StatusCode, peekBody(res), nil)
+			}
 			return &ResponseWithElapsedTime{res, elapsedTime, ""}, nil
 		}
 		body, err := ioutil.ReadAll(res.Body)
@@ -243,10 +321,50 @@ func (c *Client) doRequest(ctx context.Context, req *http.Request) (*ResponseWit
 		} else {
 			log.Printf("[INFO] retry status code: %d, body: %s", res.StatusCode, string(body))
 		}
+		debugSink.capture(fmt.Sprintf("status_%d", res.StatusCode), req, reqbody, res.StatusCode, body, err)
+		if backoff {
+			// 負荷を意図的に落としているだけなので壊れているのとは区別して数える
+			requestStats.backoff()
+			if rest := c.retireto - elapsedTime; wait > rest {
+				wait = rest
+			}
+			var done <-chan struct{}
+			if ctx != nil {
+				done = ctx.Done()
+			}
+			select {
+			case <-done:
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
 		time.Sleep(RetryInterval)
 	}
 }
 
+// retryAfter は 503 の Retry-After (秒数かHTTP日付) を解釈します
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
 func (c *Client) get(ctx context.Context, path string, val url.Values) (*ResponseWithElapsedTime, error) {
 	u, err := c.base.Parse(path)
 	if err != nil {
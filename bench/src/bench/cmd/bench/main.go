@@ -8,31 +8,67 @@ import (
 	"flag"
 	"io"
 	"log"
-	"math/rand"
 	"os"
+	"os/signal"
+	"strings"
 	"time"
 
 	"bench"
+	"bench/isubank"
 )
 
 var (
-	appep        = flag.String("appep", "https://localhost.isucon8.flying-chair.net", "app endpoint")
-	bankep       = flag.String("bankep", "https://compose.isucon8.flying-chair.net:5515", "isubank endpoint")
-	logep        = flag.String("logep", "https://compose.isucon8.flying-chair.net:5516", "isulog endpoint")
-	internalbank = flag.String("internalbank", "https://localhost.isucon8.flying-chair.net:5515", "isubank endpoint (for internal)")
-	internallog  = flag.String("internallog", "https://localhost.isucon8.flying-chair.net:5516", "isulog endpoint (for internal)")
-	jobid        = flag.String("jobid", "", "portal jobid")
-	logoutput    = flag.String("log", "", "output log path (default stderr)")
-	result       = flag.String("result", "", "result json path (default stdout)")
-	teestdout    = flag.String("teestdout", "", "tee stdout")
-	stateout     = flag.String("stateout", "", "save state filename")
-	logout       = os.Stderr
-	out          = os.Stdout
+	appep         = flag.String("appep", "https://localhost.isucon8.flying-chair.net", "app endpoint")
+	targets       = flag.String("targets", "", "comma separated app endpoints to distribute users without LB (default -appep)")
+	bankep        = flag.String("bankep", "https://compose.isucon8.flying-chair.net:5515", "isubank endpoint")
+	logep         = flag.String("logep", "https://compose.isucon8.flying-chair.net:5516", "isulog endpoint")
+	internalbank  = flag.String("internalbank", "https://localhost.isucon8.flying-chair.net:5515", "isubank endpoint (for internal)")
+	internallog   = flag.String("internallog", "https://localhost.isucon8.flying-chair.net:5516", "isulog endpoint (for internal)")
+	jobid         = flag.String("jobid", "", "portal jobid")
+	logoutput     = flag.String("log", "", "output log path (default stderr)")
+	result        = flag.String("result", "", "result json path (default stdout)")
+	teestdout     = flag.String("teestdout", "", "tee stdout")
+	stateout      = flag.String("stateout", "", "save state filename")
+	clienttimeout = flag.Duration("client-timeout", bench.ClientTimeout, "HTTP client timeout")
+	inittimeout   = flag.Duration("init-timeout", bench.InitTimeout, "initialize timeout")
+	pollinterval  = flag.Duration("poll-interval", bench.PollingInterval, "polling interval of clients")
+	http2         = flag.Bool("http2", false, "use HTTP/2 for app requests")
+	maxidleconns  = flag.Int("max-idle-conns-per-host", 100, "max idle connections per host of app requests")
+	tlsverify     = flag.Bool("tls-verify", true, "verify tls certificate of app")
+	cacert        = flag.String("ca-cert", "", "additional CA certificate (PEM) to verify app")
+	duration      = flag.Duration("duration", bench.BenchMarkTime, "duration of scored load phase")
+	maxrequests   = flag.Int64("max-requests", 0, "stop scored load phase after this many app requests, whichever of -duration comes first (0 is unlimited)")
+	soak          = flag.Bool("soak", false, "report score per minute and detect regression from the peak window (use with -duration)")
+	soakthreshold = flag.Float64("soak-threshold", 0.8, "fraction of the peak window score under which a later window is flagged")
+	bankretry     = flag.Int("bank-retry", isubank.DefaultRetryPolicy.MaxAttempts, "max attempts of idempotent isubank requests on transient errors")
+	bankdelay     = flag.Duration("bank-retry-delay", isubank.DefaultRetryPolicy.BaseDelay, "base delay of exponential backoff of isubank retries")
+	tracesample   = flag.Float64("trace-sample", 0, "fraction of app requests to record httptrace timings, 1 records all requests for -replay (0 is disabled)")
+	traceout      = flag.String("trace-out", "trace.jsonl", "output path of -trace-sample as JSON lines")
+	failfast      = flag.Bool("fail-fast", false, "stop scored load phase on the first critical error (trade inconsistency) instead of counting errors")
+	debug         = flag.Int("debug", 0, "dump first N failed requests and responses of each kind")
+	seed          = flag.Int64("seed", 0, "random seed for reproducible run (default random)")
+	bankcheck     = flag.Bool("bank-check", false, "check concurrent commit of overlapping reserves on isubank without load and scoring")
+	bankexpiry    = flag.Bool("bank-check-expiry", false, "with -bank-check, also check that expired reserves can not be committed and abandoned reserves release credit (takes isubank reserve ttl)")
+	bankgc        = flag.Bool("bank-check-gc", false, "with -bank-check-expiry, also wait until abandoned reserves are deleted by isubank -gc-interval (takes twice the reserve ttl)")
+	validate      = flag.Bool("validate", false, "validate each scenario once without load and scoring")
+	replay        = flag.String("replay", "", "replay requests recorded by -trace-sample=1 in order against -appep and report status or body differences")
+	output        = flag.String("output", "text", "result format (text|json). json outputs detailed result instead of portal result")
+	weights       = flag.String("weights", "", "relative weights of user actions e.g. order=70,trades=20,signup=10 (actions: order|trades|orders|signup, default order only)")
+	thinktime     = flag.Duration("think-time", 0, "pause of each user between operations (0 is no pause)")
+	thinkjitter   = flag.Duration("think-jitter", 0, "random jitter (+-) of -think-time")
+	ramp          = flag.Duration("ramp", 0, "ramp-up duration of initial users (default all at once)")
+	tz            = flag.String("tz", bench.DefaultLocation, "time zone of timestamps in logs and results, e.g. UTC")
+	scoreconfig   = flag.String("scoreconfig", "", "score config json path (default const.go)")
+	logout        = os.Stderr
+	out           = os.Stdout
 )
 
 func main() {
 	flag.Parse()
 	var err error
+	if err = bench.SetLocation(*tz); err != nil {
+		log.Fatal(err)
+	}
 	if *result != "" {
 		out, err = os.Create(*result)
 		if err != nil {
@@ -48,6 +84,42 @@ func main() {
 		defer logout.Close()
 	}
 	log.SetOutput(logout)
+	if *seed == 0 {
+		*seed = newSeed()
+	}
+	bench.Seed(*seed)
+	if *debug > 0 {
+		bench.EnableDebug(*debug)
+	}
+	if *tracesample > 0 {
+		if err = bench.EnableTrace(*traceout, *tracesample); err != nil {
+			log.Fatal(err)
+		}
+		defer bench.CloseTrace()
+	}
+	if *weights != "" {
+		w, err := bench.ParseWeights(*weights)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bench.EnableWeights(w)
+	}
+	bench.SetTimeouts(*clienttimeout, *inittimeout, *pollinterval)
+	bench.SetDuration(*duration)
+	bench.SetThinkTime(*thinktime, *thinkjitter)
+	bench.SetMaxRequests(*maxrequests)
+	bench.SetFailFast(*failfast)
+	tc := bench.TransportConfig{
+		HTTP2:               *http2,
+		MaxIdleConnsPerHost: *maxidleconns,
+		TLSVerify:           *tlsverify,
+	}
+	if *cacert != "" {
+		if tc.RootCAs, err = bench.LoadCACert(*cacert); err != nil {
+			log.Fatal(err)
+		}
+	}
+	bench.SetTransportConfig(tc)
 	if err = run(); err != nil {
 		log.Fatal(err)
 	}
@@ -65,29 +137,91 @@ func run() error {
 	} else {
 		writer = logout
 	}
-	mgr, err := bench.NewManager(writer, *appep, *bankep, *logep, *internalbank, *internallog, *stateout)
+	var apptargets []string
+	for _, t := range strings.Split(*targets, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			apptargets = append(apptargets, t)
+		}
+	}
+	if len(apptargets) > 0 {
+		*appep = apptargets[0]
+	}
+	if *replay != "" {
+		res, err := bench.Replay(context.Background(), *replay, *appep)
+		if res != nil {
+			log.Printf("[INFO] replay %d requests, %d mismatches", res.Total, res.Mismatches)
+			json.NewEncoder(out).Encode(res)
+		}
+		return err
+	}
+	scoreConfig, err := bench.LoadScoreConfig(*scoreconfig)
+	if err != nil {
+		return err
+	}
+	mgr, err := bench.NewManager(writer, *appep, *bankep, *logep, *internalbank, *internallog, *stateout, scoreConfig)
 	if err != nil {
 		return err
 	}
 	defer mgr.Close()
+	mgr.SetRamp(*ramp)
+	mgr.SetTargets(apptargets)
+	mgr.SetBankRetryPolicy(isubank.RetryPolicy{MaxAttempts: *bankretry, BaseDelay: *bankdelay})
+	if *soak {
+		mgr.SetSoak(bench.SoakWindow, *soakthreshold)
+	}
 	msg := "ok"
 	bm := bench.NewRunner(mgr)
+	if *bankcheck {
+		if err = bm.BankCheck(context.Background(), *bankexpiry, *bankgc); err != nil {
+			mgr.Logger().Printf("Fail => %s", err)
+			return err
+		}
+		mgr.Logger().Printf("Pass => bank check")
+		return nil
+	}
+	if *validate {
+		if err = bm.Validate(context.Background()); err != nil {
+			mgr.Logger().Printf("Fail => %s", err)
+			return err
+		}
+		mgr.Logger().Printf("Pass => validate")
+		return nil
+	}
+	// Ctrl-C では途中までの結果を出して終了する。2回目は即座に終了する
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt)
+	defer signal.Stop(sigch)
+	go func() {
+		<-sigch
+		bm.Abort()
+		<-sigch
+		os.Exit(1)
+	}()
 	if err = bm.Run(context.Background()); err != nil {
 		msg = err.Error()
 		mgr.Logger().Printf(msg)
 	}
+	if *output == "json" {
+		result := bm.DetailResult()
+		result.Message = msg
+		json.NewEncoder(out).Encode(result)
+		return nil
+	}
 	result := bm.Result()
 	result.JobID = *jobid
 	result.IPAddrs = *appep
+	if len(apptargets) > 0 {
+		result.IPAddrs = strings.Join(apptargets, ",")
+	}
 	result.Message = msg
 	json.NewEncoder(out).Encode(result)
 	return nil
 }
 
-func init() {
+func newSeed() int64 {
 	var s int64
 	if err := binary.Read(crand.Reader, binary.LittleEndian, &s); err != nil {
 		s = time.Now().UnixNano()
 	}
-	rand.Seed(s)
+	return s
 }
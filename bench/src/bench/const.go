@@ -1,6 +1,9 @@
 package bench
 
-import "time"
+import (
+	"log"
+	"time"
+)
 
 const (
 	// Timeouts
@@ -12,12 +15,15 @@ const (
 	RetireTimeout = 10 * time.Second       // clientが退役するタイムアウト時間
 	RetryInterval = 500 * time.Millisecond // 50x系でエラーになったときのretry間隔
 
+	AbortDrainTimeout = 3 * time.Second // 中断した時に実行中のリクエストを待つ時間
+
 	TestTradeTimeout = 5 * time.Second  // testでのtradeは成立までの時間
 	LogAllowedDelay  = 10 * time.Second // logの遅延が許される時間
 
 	PollingInterval     = 1000 * time.Millisecond // clientのポーリング感覚
 	OrderUpdateInterval = 1500 * time.Millisecond // 注文間隔
 	BruteForceDelay     = 500 * time.Millisecond  // 総当たりログイン試行間隔
+	SignupCheckInterval = 5000 * time.Millisecond // signup の永続化を確かめる間隔
 
 	AddUsersOnShare   = 3  // SNSシェアによって増えるユーザー数
 	AddUsersOnNatural = 2  // 自然増で増えるユーザー数
@@ -35,7 +41,80 @@ const (
 	GetInfoScore      = 1
 	GetTopScore       = 1
 
+	SignupPersistScore = 3 // 別の接続からの signin で signup の永続化を確かめた時の得点
+
+	// reconcile
+	ReconcileSampleUsers  = 20   // 取引の照合をするユーザー数
+	ReconcileHistoryLimit = 1000 // 照合に使う credit_history の件数
+
+	// reserve watch
+	ReserveWatchUsers    = 10                     // 予約から確定までの時間を調べるユーザー数
+	ReserveWatchInterval = 200 * time.Millisecond // 銀行の予約を見に行く間隔。計測の精度もこの程度です
+	ReserveRiskyMargin   = 1 * time.Second        // 期限までこれより短い時に確定した予約を risky とします。expire_at は秒単位なので1秒未満は見分けられません
+
+	// fairness
+	FairnessMinRequests = 10  // これより少ないリクエストしかしていないユーザーは偏りの集計に含めない
+	FairnessWarnRatio   = 0.2 // 一番遅いユーザーのスループットが一番速いユーザーのこれ未満なら警告する
+
+	// bank check
+	BankCheckUsers     = 5      // 予約を奪い合うユーザー数
+	BankCheckWorkers   = 20     // 同時に commit する worker 数
+	BankCheckTransfers = 10     // worker ごとの送金回数
+	BankCheckCredit    = 100000 // ユーザーごとの初期残高
+
+	// 期限の直前/直後に commit する時の余裕。commit は銀行で 300ms 待たされてから処理されます
+	BankCheckExpiryMargin = 2 * time.Second
+
+	// 放置した予約が GC で削除されるのを待つ時に期限から -reserve-ttl の後にさらに待つ時間 (銀行の -gc-interval の default の倍)
+	BankCheckGCWait = 60 * time.Second
+	// 予約の状態を見に行く間隔
+	BankCheckPollInterval = 2 * time.Second
+
 	// error
 	AllowErrorMin = 20 // levelによらずここまでは許容範囲というエラー数
 	AllowErrorMax = 50 // levelによらずこれ以上は許さないというエラー数
 )
+
+// flag で上書きできる値です。default は上の const の値です
+var (
+	clientTimeout   = ClientTimeout
+	initTimeout     = InitTimeout
+	pollingInterval = PollingInterval
+	benchMarkTime   = BenchMarkTime
+	thinkTime       time.Duration
+	thinkJitter     time.Duration
+)
+
+// SetTimeouts は HTTP client のタイムアウトとポーリング間隔を上書きします。0 以下の値は無視します
+func SetTimeouts(client, init, polling time.Duration) {
+	if client > 0 {
+		clientTimeout = client
+	}
+	if init > 0 {
+		initTimeout = init
+	}
+	if polling > 0 {
+		pollingInterval = polling
+	}
+	log.Printf("[INFO] client timeout %s, init timeout %s, polling interval %s", clientTimeout, initTimeout, pollingInterval)
+}
+
+// SetDuration は負荷走行の時間を上書きします。0 以下の値は無視します
+func SetDuration(d time.Duration) {
+	if d > 0 {
+		benchMarkTime = d
+	}
+	log.Printf("[INFO] benchmark duration %s", benchMarkTime)
+}
+
+// SetThinkTime はユーザーが操作と操作の間に d (+-jitter) だけ考える時間を入れるようにします。0 以下の場合は待ちません
+func SetThinkTime(d, jitter time.Duration) {
+	if d <= 0 {
+		return
+	}
+	if jitter > d {
+		jitter = d
+	}
+	thinkTime, thinkJitter = d, jitter
+	log.Printf("[INFO] think time %s (jitter +-%s)", thinkTime, thinkJitter)
+}
@@ -0,0 +1,66 @@
+package bench
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"unicode/utf8"
+)
+
+// DebugBodyLimit は dump する body の最大文字数です
+const DebugBodyLimit = 1000
+
+// debugSink は -debug の時に失敗したリクエストとレスポンスを種類ごとに先頭 N 件だけ出力します
+// nil の場合は何もしません
+var debugSink *debugDumper
+
+type debugDumper struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]int
+}
+
+// EnableDebug は失敗の種類ごとに max 件までリクエストとレスポンスを出力するようにします
+func EnableDebug(max int) {
+	debugSink = &debugDumper{
+		max:    max,
+		counts: make(map[string]int, 10),
+	}
+}
+
+func (d *debugDumper) capture(kind string, req *http.Request, reqbody []byte, status int, resbody []byte, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if d.counts[kind] >= d.max {
+		d.mu.Unlock()
+		return
+	}
+	d.counts[kind]++
+	n := d.counts[kind]
+	d.mu.Unlock()
+
+	log.Printf("[DEBUG] %s (%d/%d)\n> %s %s\n> %s\n< status:%d, err:%v\n< %s",
+		kind, n, d.max, req.Method, req.URL, truncateBody(reqbody), status, err, truncateBody(resbody))
+}
+
+// peekBody は body を読んで、後続の処理のために読み直せるようにしておきます
+func peekBody(res *http.Response) []byte {
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func truncateBody(b []byte) string {
+	if utf8.RuneCount(b) > DebugBodyLimit {
+		return string([]rune(string(b))[:DebugBodyLimit]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,106 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"bench/isubank"
+	"github.com/pkg/errors"
+)
+
+// ErrorType はエラーの分類です
+// タイムアウトと不正なレスポンスでは意味が全く違うので分けて数えます
+type ErrorType int
+
+const (
+	ErrorTypeTimeout ErrorType = 1 + iota
+	ErrorTypeConnectionRefused
+	ErrorTypeServerError
+	ErrorTypeUnexpectedResponse
+	ErrorTypeValidation
+	ErrorTypeBankUnavailable
+	ErrorTypeTradeInconsistency
+	ErrorTypeReconcile
+)
+
+func (et ErrorType) String() string {
+	switch et {
+	case ErrorTypeTimeout:
+		return "timeout"
+	case ErrorTypeConnectionRefused:
+		return "connection_refused"
+	case ErrorTypeServerError:
+		return "5xx"
+	case ErrorTypeUnexpectedResponse:
+		return "unexpected_response"
+	case ErrorTypeValidation:
+		return "validation_mismatch"
+	case ErrorTypeBankUnavailable:
+		return "bank_unavailable"
+	case ErrorTypeTradeInconsistency:
+		return "trade_inconsistency"
+	case ErrorTypeReconcile:
+		return "reconcile_mismatch"
+	default:
+		return fmt.Sprintf("Unknown[%d]", et)
+	}
+}
+
+// failFast は -fail-fast の時に致命的なエラーで負荷走行を打ち切るかどうかです
+var failFast bool
+
+// SetFailFast は Critical なエラーが1件でも起きたら閾値を待たずに負荷走行を打ち切るようにします
+func SetFailFast(b bool) {
+	failFast = b
+}
+
+// Critical は取引の正しさが壊れている致命的なエラーかどうかです
+// -fail-fast の時はこれらのエラーで即座に負荷走行を打ち切ります
+// ErrorTypeReconcile は負荷走行の後の Reconcile でしか起きないので含めません
+func (et ErrorType) Critical() bool {
+	switch et {
+	case ErrorTypeTradeInconsistency:
+		return true
+	default:
+		return false
+	}
+}
+
+// ClassifyError はエラーを ErrorType に分類します
+func ClassifyError(err error) ErrorType {
+	switch e := errors.Cause(err).(type) {
+	case *ErrElapsedTimeOverRetire:
+		return ErrorTypeTimeout
+	case *ErrTradeInconsistent:
+		return ErrorTypeTradeInconsistency
+	case *ErrReconcile:
+		return ErrorTypeReconcile
+	case *ErrorWithStatus:
+		if e.StatusCode >= 500 {
+			return ErrorTypeServerError
+		}
+		return ErrorTypeUnexpectedResponse
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return ErrorTypeUnexpectedResponse
+	case net.Error:
+		if e.Timeout() {
+			return ErrorTypeTimeout
+		}
+	}
+	switch errors.Cause(err) {
+	case context.DeadlineExceeded:
+		return ErrorTypeTimeout
+	case isubank.ErrBreakerOpen:
+		return ErrorTypeBankUnavailable
+	case io.EOF, io.ErrUnexpectedEOF:
+		return ErrorTypeUnexpectedResponse
+	}
+	if strings.Contains(err.Error(), "connection refused") {
+		return ErrorTypeConnectionRefused
+	}
+	return ErrorTypeValidation
+}
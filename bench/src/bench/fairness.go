@@ -0,0 +1,111 @@
+package bench
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FairnessResult はユーザーごとのスループットの偏りです
+// 一部のユーザーだけを待たせる app では Ratio が小さくなります
+type FairnessResult struct {
+	Users       int     `json:"users"`          // 集計したユーザー数 (FairnessMinRequests 回以上リクエストしたユーザー)
+	MinRPS      float64 `json:"min_rps"`        // 一番遅いユーザーの成功したリクエスト数/秒
+	MaxRPS      float64 `json:"max_rps"`        // 一番速いユーザーの成功したリクエスト数/秒
+	Ratio       float64 `json:"ratio"`          // MinRPS / MaxRPS
+	MinLatency  float64 `json:"min_latency_ms"` // ユーザーごとの平均レイテンシの最小
+	MaxLatency  float64 `json:"max_latency_ms"` // ユーザーごとの平均レイテンシの最大
+	SlowestUser string  `json:"slowest_user"`   // 一番遅いユーザーの bank_id
+	Unfair      bool    `json:"unfair"`         // Ratio が FairnessWarnRatio を下回った
+}
+
+// userStats は負荷走行中の app へのリクエストを bank_id ごとに集計します
+// Client はいろいろな所で作られるので requestStats と同じく package で1つ持ちます
+var userStats = &userStatMap{
+	stats: make(map[string]*userStat, 1000),
+}
+
+type userStatMap struct {
+	mu     sync.Mutex
+	stats  map[string]*userStat
+	active int32
+}
+
+type userStat struct {
+	success int64
+	fail    int64
+	latency time.Duration
+	first   time.Time
+	last    time.Time
+}
+
+// start は負荷走行の開始から集計します。事前テストや事後テストのリクエストは数えません
+func (s *userStatMap) start() {
+	atomic.StoreInt32(&s.active, 1)
+}
+
+func (s *userStatMap) stop() {
+	atomic.StoreInt32(&s.active, 0)
+}
+
+func (s *userStatMap) record(bankID string, statusCode int, elapsed time.Duration) {
+	if bankID == "" || atomic.LoadInt32(&s.active) == 0 {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.stats[bankID]
+	if !ok {
+		st = &userStat{first: now.Add(-elapsed)}
+		s.stats[bankID] = st
+	}
+	if 0 < statusCode && statusCode < 400 {
+		st.success++
+	} else {
+		st.fail++
+	}
+	st.latency += elapsed
+	st.last = now
+}
+
+// result は集計したユーザーがいなければ nil を返します
+func (s *userStatMap) result() *FairnessResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r *FairnessResult
+	for bankID, st := range s.stats {
+		n := st.success + st.fail
+		d := st.last.Sub(st.first)
+		if n < FairnessMinRequests || d <= 0 {
+			continue
+		}
+		rps := float64(st.success) / d.Seconds()
+		latency := float64(st.latency) / float64(n) / float64(time.Millisecond)
+		if r == nil {
+			r = &FairnessResult{MinRPS: rps, MaxRPS: rps, MinLatency: latency, MaxLatency: latency, SlowestUser: bankID}
+		}
+		r.Users++
+		if rps < r.MinRPS {
+			r.MinRPS = rps
+			r.SlowestUser = bankID
+		}
+		if rps > r.MaxRPS {
+			r.MaxRPS = rps
+		}
+		if latency < r.MinLatency {
+			r.MinLatency = latency
+		}
+		if latency > r.MaxLatency {
+			r.MaxLatency = latency
+		}
+	}
+	if r == nil {
+		return nil
+	}
+	if r.MaxRPS > 0 {
+		r.Ratio = r.MinRPS / r.MaxRPS
+	}
+	r.Unfair = r.Users > 1 && r.Ratio < FairnessWarnRatio
+	return r
+}
@@ -17,7 +17,7 @@ type FinalState struct {
 }
 
 func (s *FinalState) Check(ctx context.Context) error {
-	client, err := NewClient(s.BaseURL, s.BankID, s.Name, s.Pass, ClientTimeout, RetireTimeout)
+	client, err := NewClient(s.BaseURL, s.BankID, s.Name, s.Pass, clientTimeout, RetireTimeout)
 	if err != nil {
 		return errors.Wrap(err, "NewClient failed")
 	}
@@ -4,17 +4,30 @@ import (
 	"log"
 	"os"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// DefaultLocation は time.Local の default です。-tz で変更できます
+const DefaultLocation = "Asia/Tokyo"
+
 func init() {
-	var err error
-	loc, err := time.LoadLocation("Asia/Tokyo")
-	if err != nil {
-		log.Panicln(err)
+	// tzdata が無い環境でも import で panic しないように、読めなければそのままにする
+	if err := SetLocation(DefaultLocation); err != nil {
+		log.Printf("[WARN] %s", err)
 	}
-	time.Local = loc
 
 	// 見せない内部ログ用
 	log.SetFlags(log.Lshortfile | log.LstdFlags | log.Lmicroseconds)
 	log.SetOutput(os.Stderr)
 }
+
+// SetLocation は time.Local を name (Asia/Tokyo や UTC など) にします
+func SetLocation(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return errors.Wrapf(err, "load location %s failed", name)
+	}
+	time.Local = loc
+	return nil
+}
@@ -0,0 +1,102 @@
+package isubank
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// BreakerThreshold 回連続で失敗したら breaker を open にします
+	BreakerThreshold = 5
+	// BreakerCooldown の間は open のまま即座に失敗させ、その後 half-open で1件だけ試します
+	BreakerCooldown = 5 * time.Second
+)
+
+var ErrBreakerOpen = errors.New("isubank circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker は isubank 自体が落ちている時に、全 worker が retry し続けないようにします
+type breaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *breaker) setState(s breakerState) {
+	if b.state != s {
+		log.Printf("[WARN] isubank circuit breaker: %s -> %s", b.state, s)
+		b.state = s
+	}
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < BreakerCooldown {
+			return ErrBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *breaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= BreakerThreshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// do は isubank へのリクエストを breaker 越しに行います
+// 通信エラーと 5xx を失敗として数えます
+func (b *breaker) do(f func() (int, error)) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	status, err := f()
+	b.done(status == 0 || status >= 500)
+	return err
+}
@@ -3,34 +3,70 @@ package isubank
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+var (
+	ErrCreditInsufficient      = errors.New("credit is insufficient")
+	ErrReserveExpired          = errors.New("reserve is already expired")
+	ErrReserveAlreadyCommitted = errors.New("reserve is already committed")
+)
+
+// codeErrors は isubank のエラーコードに対応するエラーです
+var codeErrors = map[string]error{
+	"insufficient_credit":       ErrCreditInsufficient,
+	"reserve_expired":           ErrReserveExpired,
+	"reserve_already_committed": ErrReserveAlreadyCommitted,
+}
+
 type isubankResponse interface {
 	SetStatus(int)
+	Status() int
 }
 
 type isubankBasicResponse struct {
 	status int
 	Error  string `json:"error"`
+	Code   string `json:"code"`
 }
 
 func (r *isubankBasicResponse) Success() bool {
 	return r.status == 200
 }
 
+// Err は失敗したレスポンスをエラーにします
+// 業務エラーは errors.Cause で ErrCreditInsufficient などと比較できます
+func (r *isubankBasicResponse) Err(format string, args ...interface{}) error {
+	if e, ok := codeErrors[r.Code]; ok {
+		return errors.Wrapf(e, format, args...)
+	}
+	if r.Error == ErrCreditInsufficient.Error() {
+		return errors.Wrapf(ErrCreditInsufficient, format, args...)
+	}
+	return errors.Errorf("%s, status:%d, err:%s", fmt.Sprintf(format, args...), r.status, r.Error)
+}
+
 func (r *isubankBasicResponse) SetStatus(s int) {
 	r.status = s
 }
 
+func (r *isubankBasicResponse) Status() int {
+	return r.status
+}
+
 type Isubank struct {
 	endpoint *url.URL
 	appid    string
+	breaker  *breaker
+	retry    RetryPolicy
+	retries  int64
 }
 
 func NewIsubank(endpoint, appid string) (*Isubank, error) {
@@ -41,6 +77,8 @@ func NewIsubank(endpoint, appid string) (*Isubank, error) {
 	return &Isubank{
 		endpoint: u,
 		appid:    appid,
+		breaker:  &breaker{},
+		retry:    DefaultRetryPolicy,
 	}, nil
 }
 
@@ -48,15 +86,16 @@ func (b *Isubank) AppID() string {
 	return b.appid
 }
 
-func (b *Isubank) NewBankID(bankid string) error {
+// Register は bankid のユーザーを作成します
+func (b *Isubank) Register(bankid string) error {
 	var res isubankBasicResponse
-	if err := b.request("/register", map[string]interface{}{"bank_id": bankid}, &res); err != nil {
+	if err := b.requestWithRetry("/register", map[string]interface{}{"bank_id": bankid}, &res); err != nil {
 		return err
 	}
 	if res.Success() {
 		return nil
 	}
-	return errors.Errorf("/register failed. %s", res.Error)
+	return res.Err("failed register. bankid:%s", bankid)
 }
 
 func (b *Isubank) AddCredit(bankid string, price int64) error {
@@ -67,7 +106,33 @@ func (b *Isubank) AddCredit(bankid string, price int64) error {
 	if res.Success() {
 		return nil
 	}
-	return errors.Errorf("failed add credit. bankid:%s, price:%d, err:%s", bankid, price, res.Error)
+	return res.Err("failed add credit. bankid:%s, price:%d", bankid, price)
+}
+
+// AddCreditWithKey は idempotency key 付きで残高を追加します
+// 同じ key の再送は銀行で無視されるので、一時的なエラーの時は retry します
+func (b *Isubank) AddCreditWithKey(bankid string, price int64, key string) error {
+	var res isubankBasicResponse
+	if err := b.requestWithRetry("/add_credit", map[string]interface{}{"bank_id": bankid, "price": price, "idempotency_key": key}, &res); err != nil {
+		return err
+	}
+	if res.Success() {
+		return nil
+	}
+	return res.Err("failed add credit. bankid:%s, price:%d", bankid, price)
+}
+
+// Check は bankid が price 以上の残高を持っているかを確認します
+// 足りない場合は ErrCreditInsufficient を返します
+func (b *Isubank) Check(bankid string, price int64) error {
+	var res isubankBasicResponse
+	if err := b.requestWithRetry("/check", map[string]interface{}{"bank_id": bankid, "price": price}, &res); err != nil {
+		return err
+	}
+	if res.Success() {
+		return nil
+	}
+	return res.Err("failed check. bankid:%s, price:%d", bankid, price)
 }
 
 func (b *Isubank) GetCredit(bankid string) (int64, error) {
@@ -75,26 +140,177 @@ func (b *Isubank) GetCredit(bankid string) (int64, error) {
 	*u = *b.endpoint
 	u.Path = path.Join(u.Path, "/credit")
 	u.RawQuery = url.Values{"bank_id": []string{bankid}}.Encode()
-	res, err := http.Get(u.String())
+	var credit int64
+	err := b.breaker.do(func() (int, error) {
+		res, err := http.Get(u.String())
+		if err != nil {
+			return 0, errors.Wrap(err, "isubank get_credit failed")
+		}
+		defer res.Body.Close()
+		if res.StatusCode == 200 {
+			type Res struct {
+				Credit int64 `json:"credit"`
+			}
+			var r Res
+			if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+				return res.StatusCode, errors.Wrap(err, "isubank get_credit decode failed")
+			}
+			credit = r.Credit
+			return res.StatusCode, nil
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return res.StatusCode, errors.Wrap(err, "isubank read body failed")
+		}
+		return res.StatusCode, errors.Errorf("isubank getCredit failed. [status:%d, body:%s]", res.StatusCode, string(body))
+	})
 	if err != nil {
-		return 0, errors.Wrap(err, "isubank get_credit failed")
+		return 0, err
+	}
+	return credit, nil
+}
+
+type Credit struct {
+	ID        int64     `json:"id"`
+	Amount    int64     `json:"amount"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreditHistory は bankid の残高の変動履歴を新しい順に limit 件まで返します
+func (b *Isubank) CreditHistory(bankid string, limit int) ([]Credit, error) {
+	var res struct {
+		isubankBasicResponse
+		Credits []Credit `json:"credits"`
+	}
+	if err := b.request("/credit_history", map[string]interface{}{"bank_id": bankid, "limit": limit}, &res); err != nil {
+		return nil, err
+	}
+	if res.Success() {
+		return res.Credits, nil
+	}
+	return nil, res.Err("failed credit history. bankid:%s", bankid)
+}
+
+// ActiveReserve は期限内で未確定の予約です
+type ActiveReserve struct {
+	ID       int64     `json:"id"`
+	Amount   int64     `json:"amount"`
+	Note     string    `json:"note"`
+	IsMinus  bool      `json:"is_minus"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+// Reserves は bankid の期限内の予約を ID 順に返します
+func (b *Isubank) Reserves(bankid string) ([]ActiveReserve, error) {
+	var res struct {
+		isubankBasicResponse
+		Reserves []ActiveReserve `json:"reserves"`
+	}
+	if err := b.request("/reserves", map[string]interface{}{"bank_id": bankid}, &res); err != nil {
+		return nil, err
 	}
-	defer res.Body.Close()
-	if res.StatusCode == 200 {
-		type Res struct {
-			Credit int64 `json:"credit"`
+	if res.Success() {
+		return res.Reserves, nil
+	}
+	return nil, res.Err("failed reserves. bankid:%s", bankid)
+}
+
+// Reserve は bankid の price の予約を作成して予約IDを返します
+func (b *Isubank) Reserve(bankid string, price int64) (int64, error) {
+	id, _, err := b.ReserveWithExpiry(bankid, price)
+	return id, err
+}
+
+// ReserveWithExpiry は予約を作成して予約IDと銀行の時刻での期限を返します
+func (b *Isubank) ReserveWithExpiry(bankid string, price int64) (int64, time.Time, error) {
+	var res struct {
+		isubankBasicResponse
+		ReserveID int64     `json:"reserve_id"`
+		ExpireAt  time.Time `json:"expire_at"`
+	}
+	if err := b.request("/reserve", map[string]interface{}{"bank_id": bankid, "price": price}, &res); err != nil {
+		return 0, time.Time{}, err
+	}
+	if res.Success() {
+		return res.ReserveID, res.ExpireAt, nil
+	}
+	return 0, time.Time{}, res.Err("failed reserve. bankid:%s, price:%d", bankid, price)
+}
+
+// Time は銀行の現在時刻を返します
+// 予約の期限は銀行の時刻で判定されるので、期限の前後を狙う時はこちらを基準にします
+func (b *Isubank) Time() (time.Time, error) {
+	u := new(url.URL)
+	*u = *b.endpoint
+	u.Path = path.Join(u.Path, "/time")
+	var now time.Time
+	err := b.breaker.do(func() (int, error) {
+		res, err := http.Get(u.String())
+		if err != nil {
+			return 0, errors.Wrap(err, "isubank time failed")
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return res.StatusCode, errors.Errorf("isubank time failed. [status:%d]", res.StatusCode)
+		}
+		var r struct {
+			Now time.Time `json:"now"`
 		}
-		var r Res
 		if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
-			return 0, errors.Wrap(err, "isubank get_credit decode failed")
+			return res.StatusCode, errors.Wrap(err, "isubank time decode failed")
 		}
-		return r.Credit, nil
+		now = r.Now
+		return res.StatusCode, nil
+	})
+	return now, err
+}
+
+// ReserveStatus は予約ごとの状態 (active|expired|not_found) を返します
+// not_found は確定、取り消し、または期限切れの後に削除された予約です
+func (b *Isubank) ReserveStatus(reserveIDs []int64) (map[int64]string, error) {
+	var res struct {
+		isubankBasicResponse
+		Reserves []struct {
+			ID     int64  `json:"id"`
+			Status string `json:"status"`
+		} `json:"reserves"`
 	}
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return 0, errors.Wrap(err, "isubank read body failed")
+	if err := b.request("/reserve_status", map[string]interface{}{"reserve_ids": reserveIDs}, &res); err != nil {
+		return nil, err
+	}
+	if !res.Success() {
+		return nil, res.Err("failed reserve status. reserve_ids:%v", reserveIDs)
 	}
-	return 0, errors.Errorf("isubank getCredit failed. [status:%d, body:%s]", res.StatusCode, string(body))
+	r := make(map[int64]string, len(res.Reserves))
+	for _, rs := range res.Reserves {
+		r[rs.ID] = rs.Status
+	}
+	return r, nil
+}
+
+// Commit は reserveIDs の予約をまとめて確定します
+func (b *Isubank) Commit(reserveIDs []int64) error {
+	var res isubankBasicResponse
+	if err := b.request("/commit", map[string]interface{}{"reserve_ids": reserveIDs}, &res); err != nil {
+		return err
+	}
+	if res.Success() {
+		return nil
+	}
+	return res.Err("failed commit. reserve_ids:%v", reserveIDs)
+}
+
+// Cancel は reserveIDs の予約をまとめて取り消します
+func (b *Isubank) Cancel(reserveIDs []int64) error {
+	var res isubankBasicResponse
+	if err := b.request("/cancel", map[string]interface{}{"reserve_ids": reserveIDs}, &res); err != nil {
+		return err
+	}
+	if res.Success() {
+		return nil
+	}
+	return res.Err("failed cancel. reserve_ids:%v", reserveIDs)
 }
 
 func (b *Isubank) request(p string, v map[string]interface{}, r isubankResponse) error {
@@ -102,18 +318,26 @@ func (b *Isubank) request(p string, v map[string]interface{}, r isubankResponse)
 	*u = *b.endpoint
 	u.Path = path.Join(u.Path, p)
 
-	body := &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(v); err != nil {
-		return errors.Wrap(err, "isubank json encode failed")
-	}
-	res, err := http.Post(u.String(), "application/json", body)
+	body, err := json.Marshal(v)
 	if err != nil {
-		return errors.Wrap(err, "isubank request failed")
-	}
-	defer res.Body.Close()
-	if err = json.NewDecoder(res.Body).Decode(r); err != nil {
-		return errors.Wrap(err, "isubank decode json failed")
+		return errors.Wrap(err, "isubank json encode failed")
 	}
-	r.SetStatus(res.StatusCode)
-	return nil
+	return b.breaker.do(func() (int, error) {
+		req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+		if err != nil {
+			return 0, errors.Wrap(err, "isubank new request failed")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+b.appid)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, errors.Wrap(err, "isubank request failed")
+		}
+		defer res.Body.Close()
+		r.SetStatus(res.StatusCode)
+		if err = json.NewDecoder(res.Body).Decode(r); err != nil {
+			return res.StatusCode, errors.Wrap(err, "isubank decode json failed")
+		}
+		return res.StatusCode, nil
+	})
 }
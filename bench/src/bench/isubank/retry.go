@@ -0,0 +1,53 @@
+package isubank
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy は一時的なエラー(通信エラーと 5xx)の時の retry の設定です
+// retry するのは何度実行しても結果が変わらない操作と、idempotency key 付きの操作だけです
+type RetryPolicy struct {
+	MaxAttempts int           // 1 回目を含めた最大試行回数。1 以下なら retry しません
+	BaseDelay   time.Duration // n 回目の retry の前に BaseDelay * 2^(n-1) 待ちます
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+}
+
+func (b *Isubank) SetRetryPolicy(p RetryPolicy) {
+	b.retry = p
+}
+
+// Retries はこれまでに retry した回数です
+func (b *Isubank) Retries() int64 {
+	return atomic.LoadInt64(&b.retries)
+}
+
+// requestWithRetry は idempotent な request を RetryPolicy に従って retry します
+func (b *Isubank) requestWithRetry(p string, v map[string]interface{}, r isubankResponse) error {
+	delay := b.retry.BaseDelay
+	for attempt := 1; ; attempt++ {
+		r.SetStatus(0)
+		err := b.request(p, v, r)
+		if errors.Cause(err) == ErrBreakerOpen {
+			return err
+		}
+		if status := r.Status(); status > 0 && status < 500 {
+			// 4xx は retry しても変わらない
+			return err
+		}
+		if attempt >= b.retry.MaxAttempts {
+			return err
+		}
+		atomic.AddInt64(&b.retries, 1)
+		log.Printf("[INFO] isubank retry %s (%d/%d). status:%d, err:%v", p, attempt, b.retry.MaxAttempts-1, r.Status(), err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
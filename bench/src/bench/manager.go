@@ -24,6 +24,7 @@ type Manager struct {
 	bankep    string
 	logep     string
 	rand      *Random
+	rng       *rand.Rand
 	isubank   *isubank.Isubank
 	isulog    *isulog.Isulog
 	idlist    chan string
@@ -36,14 +37,27 @@ type Manager struct {
 	scenarioLock sync.Mutex
 	level        uint
 	overError    bool
+	critical     error
 
 	scounter   int32
 	scoreboard *ScoreBoard
+	scoreconf  *ScoreConfig
 	testusers  []TestUser
 	statefile  string
+	ramp       time.Duration
+	windows    *scoreWindows
+	threshold  float64
+	targets    []string
+	tcounter   uint32
+	stop       chan struct{}
+	stopOnce   sync.Once
+	reserves   *reserveWatch
 }
 
-func NewManager(out io.Writer, appep, bankep, logep, internalbank, internallog string, statefile string) (*Manager, error) {
+func NewManager(out io.Writer, appep, bankep, logep, internalbank, internallog string, statefile string, scoreConfig *ScoreConfig) (*Manager, error) {
+	if scoreConfig == nil {
+		scoreConfig = DefaultScoreConfig()
+	}
 	rnd, err := NewRandom()
 	if err != nil {
 		return nil, err
@@ -57,12 +71,14 @@ func NewManager(out io.Writer, appep, bankep, logep, internalbank, internallog s
 		return nil, err
 	}
 	scoreboard := &ScoreBoard{
-		count: make(map[ScoreType]int64, 20),
+		count:  make(map[ScoreType]int64, 20),
+		config: scoreConfig,
 	}
+	rng := rand.New(newLockedSource(seed))
 	_testusers := make([]TestUser, len(testUsers))
 	copy(_testusers, testUsers)
 	for i := range _testusers {
-		j := rand.Intn(i + 1)
+		j := rng.Intn(i + 1)
 		_testusers[i], _testusers[j] = _testusers[j], _testusers[i]
 	}
 	logs := &bytes.Buffer{}
@@ -72,6 +88,7 @@ func NewManager(out io.Writer, appep, bankep, logep, internalbank, internallog s
 		bankep:     bankep,
 		logep:      logep,
 		rand:       rnd,
+		rng:        rng,
 		isubank:    bank,
 		isulog:     isulog,
 		idlist:     make(chan string, 10),
@@ -79,14 +96,62 @@ func NewManager(out io.Writer, appep, bankep, logep, internalbank, internallog s
 		logs:       logs,
 		scenarios:  make([]Scenario, 0, 2000),
 		scoreboard: scoreboard,
+		scoreconf:  scoreConfig,
 		testusers:  _testusers,
 		statefile:  statefile,
+		targets:    []string{appep},
+		stop:       make(chan struct{}),
+		reserves:   newReserveWatch(),
 	}, nil
 }
 
 func (c *Manager) Close() {
 }
 
+// SetRamp は初期ユーザーを ramp の間に1人から DefaultWorkers まで線形に増やすようにします
+// 0 の場合は従来通り一斉に開始します
+func (c *Manager) SetRamp(ramp time.Duration) {
+	c.ramp = ramp
+}
+
+// SetSoak は得点を window ごとに集計し、peak から threshold の割合を下回った window を検出するようにします
+func (c *Manager) SetSoak(window time.Duration, threshold float64) {
+	c.windows = newScoreWindows(window)
+	c.threshold = threshold
+}
+
+// SetTargets は負荷走行のユーザーを targets に順番に割り振るようにします
+// セッションを保持している app もあるので、1人のユーザーのリクエストは常に同じ target に送ります
+// initialize と事前/事後テストは appep に対して行います
+func (c *Manager) SetTargets(targets []string) {
+	if len(targets) > 0 {
+		c.targets = targets
+	}
+}
+
+func (c *Manager) nextTarget() string {
+	i := atomic.AddUint32(&c.tcounter, 1)
+	return c.targets[int(i-1)%len(c.targets)]
+}
+
+// SetBankRetryPolicy は isubank への idempotent なリクエストの retry の設定をします
+func (c *Manager) SetBankRetryPolicy(p isubank.RetryPolicy) {
+	c.isubank.SetRetryPolicy(p)
+}
+
+// BankRetries は isubank へのリクエストを retry した回数です
+func (c *Manager) BankRetries() int64 {
+	return c.isubank.Retries()
+}
+
+// SoakResult は -soak が指定されていない場合は nil を返します
+func (c *Manager) SoakResult(end time.Time) *SoakResult {
+	if c.windows == nil {
+		return nil
+	}
+	return newSoakResult(c.windows.size, c.windows.complete(end), c.threshold)
+}
+
 // benchに影響を与えないようにidは予め用意しておく
 func (c *Manager) RunIDFetcher(ctx context.Context) {
 	for {
@@ -95,7 +160,7 @@ func (c *Manager) RunIDFetcher(ctx context.Context) {
 			return
 		default:
 			id := c.rand.ID()
-			if err := c.isubank.NewBankID(id); err != nil {
+			if err := c.isubank.Register(id); err != nil {
 				log.Printf("new bankid failed. %s", err)
 			}
 			c.idlist <- id
@@ -125,6 +190,15 @@ func (c *Manager) AppendError(e error) error {
 	c.errors = append(c.errors, e)
 	ec := len(c.errors)
 
+	if failFast {
+		if et := ClassifyError(e); et.Critical() {
+			c.critical = e
+			log.Printf("[CRITICAL] %s: %s", et, e)
+			c.Logger().Printf("致命的なエラーが発生したため終了します: %s", e)
+			return errors.Wrapf(e, "致命的なエラー(%s)", et)
+		}
+	}
+
 	errorLimit := c.GetScore() / 500
 	if errorLimit < AllowErrorMin {
 		errorLimit = AllowErrorMin
@@ -138,6 +212,13 @@ func (c *Manager) AppendError(e error) error {
 	return nil
 }
 
+// Critical は -fail-fast で負荷走行を打ち切った致命的なエラーです
+func (c *Manager) Critical() error {
+	c.errorLock.Lock()
+	defer c.errorLock.Unlock()
+	return c.critical
+}
+
 func (c *Manager) ErrorCount() int {
 	c.errorLock.Lock()
 	defer c.errorLock.Unlock()
@@ -152,6 +233,17 @@ func (c *Manager) GetErrorsString() []string {
 	return r
 }
 
+// ErrorsByType はエラーを ErrorType ごとに数えます
+func (c *Manager) ErrorsByType() map[string]int {
+	c.errorLock.Lock()
+	defer c.errorLock.Unlock()
+	r := make(map[string]int, 10)
+	for _, e := range c.errors {
+		r[ClassifyError(e).String()]++
+	}
+	return r
+}
+
 func (c *Manager) GetLogs() ([]string, error) {
 	scan := bufio.NewScanner(c.logs)
 	r := []string{}
@@ -188,6 +280,8 @@ func (c *Manager) AllUsers() int {
 }
 
 func (c *Manager) ActiveUsers() int {
+	c.scenarioLock.Lock()
+	defer c.scenarioLock.Unlock()
 	n := 0
 	for _, sc := range c.scenarios {
 		if !sc.IsRetired() {
@@ -206,7 +300,7 @@ func (c *Manager) Initialize(ctx context.Context) error {
 		return errors.Wrap(err, "isuloggerの初期化に失敗しました。運営に連絡してください")
 	}
 
-	guest, err := NewClient(c.appep, "", "", "", InitTimeout, InitTimeout)
+	guest, err := NewClient(c.appep, "", "", "", initTimeout, initTimeout)
 	if err != nil {
 		return err
 	}
@@ -218,6 +312,7 @@ func (c *Manager) Initialize(ctx context.Context) error {
 
 func (c *Manager) PreTest(ctx context.Context) error {
 	t := &PreTester{
+		rnd:     c.rng,
 		appep:   c.appep,
 		isubank: c.isubank,
 		isulog:  c.isulog,
@@ -235,6 +330,7 @@ func (c *Manager) PostTest(ctx context.Context) error {
 		}
 	}
 	t := &PostTester{
+		rnd:     c.rng,
 		appep:   c.appep,
 		isubank: c.isubank,
 		isulog:  c.isulog,
@@ -284,6 +380,7 @@ func (c *Manager) ScenarioStart(ctx context.Context) error {
 	cctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var err error
+	c.windows.begin(time.Now())
 
 	go func() {
 		defer cancel()
@@ -294,7 +391,13 @@ func (c *Manager) ScenarioStart(ctx context.Context) error {
 
 	go c.tickScenario(cctx, smchan)
 
-	if err := c.startScenarios(cctx, smchan, DefaultWorkers); err != nil {
+	go c.runSignupCheck(cctx, smchan)
+
+	go c.runReserveWatch(cctx)
+
+	if c.ramp > 0 {
+		go c.rampScenarios(cctx, smchan, DefaultWorkers, c.ramp)
+	} else if err := c.startScenarios(cctx, smchan, DefaultWorkers); err != nil {
 		return nil
 	}
 	<-cctx.Done()
@@ -319,20 +422,22 @@ func (c *Manager) newScenario() (Scenario, error) {
 	var credit, isu, unit int64
 	var justprice bool
 	n := atomic.AddInt32(&c.scounter, 1)
+	// シナリオごとに乱数を分けて、goroutine の実行順で他のシナリオの乱数が変わらないようにする
+	rng := rand.New(newLockedSource(seed + int64(n)))
 	switch {
 	case n%10 == 3:
 		if tu := c.nextTestUser(10); tu.BankID != "" {
-			cl, err := NewClient(c.appep, tu.BankID, tu.Name, "12345", ClientTimeout, RetireTimeout)
+			cl, err := NewClient(c.nextTarget(), tu.BankID, tu.Name, "12345", clientTimeout, RetireTimeout)
 			if err != nil {
 				return nil, err
 			}
 			log.Printf("[DEBUG] add BruteForce %s cost:%d, orders:%d", tu.BankID, tu.Cost, tu.Orders)
-			return NewBruteForceScenario(cl), nil
+			return NewBruteForceScenario(cl, rng), nil
 		}
 		fallthrough
 	case n%5 == 2:
 		if tu := c.nextTestUser(6); tu.BankID != "" {
-			cl, err := NewClient(c.appep, tu.BankID, tu.Name, tu.Pass, ClientTimeout, RetireTimeout)
+			cl, err := NewClient(c.nextTarget(), tu.BankID, tu.Name, tu.Pass, clientTimeout, RetireTimeout)
 			if err != nil {
 				return nil, err
 			}
@@ -342,7 +447,7 @@ func (c *Manager) newScenario() (Scenario, error) {
 				return nil, err
 			}
 			log.Printf("[DEBUG] add exists user %s cost:%d, orders:%d", tu.BankID, tu.Cost, tu.Orders)
-			return NewExistsUserScenario(cl, credit, 10, 3, false), nil
+			return NewExistsUserScenario(cl, credit, 10, 3, false, rng), nil
 		}
 		fallthrough
 	case n == 10 || n == 20 || n == 30:
@@ -356,42 +461,96 @@ func (c *Manager) newScenario() (Scenario, error) {
 	default:
 		credit, isu, unit = 35000, 7, 3
 	}
-	cl, err := NewClient(c.appep, c.FetchNewID(), c.rand.Name(), c.rand.Password(), ClientTimeout, RetireTimeout)
+	cl, err := NewClient(c.nextTarget(), c.FetchNewID(), c.rand.Name(), c.rand.Password(), clientTimeout, RetireTimeout)
 	if err != nil {
 		return nil, err
 	}
 	if credit > 0 {
-		c.isubank.AddCredit(cl.bankid, credit)
+		// 新しいユーザーへの入金は1回だけで、idempotency key は user ごとなので固定の key で retry できます
+		if err := c.isubank.AddCreditWithKey(cl.bankid, credit, "initial-credit"); err != nil {
+			return nil, errors.Wrap(err, "isubank add credit failed")
+		}
+	}
+	return NewNormalScenario(cl, credit, isu, unit, justprice, rng), nil
+}
+
+// Stop は新しいユーザーを追加せず、各ユーザーにも新しい操作を始めないようにします
+// 実行中のリクエストはそのまま終わるのを待ちます
+func (c *Manager) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *Manager) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
 	}
-	return NewNormalScenario(cl, credit, isu, unit, justprice), nil
 }
 
 func (c *Manager) startScenarios(ctx context.Context, smchan chan ScoreMsg, num int) error {
 	for i := 0; i < num; i++ {
-		go func() {
-			time.Sleep(time.Duration(rand.Int63n(100)) * time.Millisecond)
-			scenario, err := c.newScenario()
-			if err != nil {
-				log.Printf("[WARN] newScenario failed. err: %s", err)
-				return
-			}
-			// add
-			if err := scenario.Start(ctx, smchan); err != nil {
-				switch errors.Cause(err) {
-				case context.DeadlineExceeded, context.Canceled:
-				default:
-					log.Printf("[INFO] scenario.Start user:%s, failed. %s", scenario.BankID(), err)
-				}
-			} else {
-				c.scenarioLock.Lock()
-				c.scenarios = append(c.scenarios, scenario)
-				c.scenarioLock.Unlock()
-			}
-		}()
+		go c.startScenario(ctx, smchan, false)
 	}
 	return nil
 }
 
+// startScenario は新しいユーザーを1人開始します
+// bySignup は -weights の signup で追加されたユーザーで、そのユーザーはさらに signup でユーザーを増やしません
+// 増やせるようにすると signup の重みがあるだけでユーザー数が指数的に増えるためです
+func (c *Manager) startScenario(ctx context.Context, smchan chan ScoreMsg, bySignup bool) {
+	time.Sleep(time.Duration(c.rng.Int63n(100)) * time.Millisecond)
+	if c.stopped() {
+		return
+	}
+	scenario, err := c.newScenario()
+	if err != nil {
+		log.Printf("[WARN] newScenario failed. err: %s", err)
+		return
+	}
+	if s, ok := scenario.(*normalScenario); ok {
+		s.bySignup = bySignup
+	}
+	scenario.setStop(c.stop)
+	// add
+	if err := scenario.Start(ctx, smchan); err != nil {
+		switch errors.Cause(err) {
+		case context.DeadlineExceeded, context.Canceled:
+		default:
+			log.Printf("[INFO] scenario.Start user:%s, failed. %s", scenario.BankID(), err)
+		}
+	} else {
+		c.scenarioLock.Lock()
+		c.scenarios = append(c.scenarios, scenario)
+		c.scenarioLock.Unlock()
+	}
+}
+
+// rampScenarios は num 人のユーザーを ramp の間に均等な間隔で開始します
+func (c *Manager) rampScenarios(ctx context.Context, smchan chan ScoreMsg, num int, ramp time.Duration) {
+	interval := ramp
+	if num > 1 {
+		interval = ramp / time.Duration(num-1)
+	}
+	for i := 1; i <= num; i++ {
+		if e := c.startScenarios(ctx, smchan, 1); e != nil {
+			log.Printf("[INFO] scenario.Start failed. %s", e)
+		}
+		c.Logger().Printf("ramp up: %d/%d (active users: %d)", i, num, c.ActiveUsers())
+		if i == num {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
 func (c *Manager) tickScenario(ctx context.Context, smchan chan ScoreMsg) {
 	for {
 		select {
@@ -427,9 +586,13 @@ func (c *Manager) recvScoreMsg(ctx context.Context, smchan chan ScoreMsg) error
 			handleContextErr(ctx.Err())
 			return nil
 		case s := <-smchan:
+			if s.signup {
+				go c.startScenario(ctx, smchan, true)
+				continue
+			}
 			if s.err != nil {
 				switch errors.Cause(s.err) {
-				case ErrAlreadyRetired, context.DeadlineExceeded, context.Canceled:
+				case ErrAlreadyRetired, ErrRequestLimit, context.DeadlineExceeded, context.Canceled:
 				default:
 					c.Logger().Printf("error: %s", s.err)
 					if e := c.AppendError(s.err); e != nil {
@@ -437,7 +600,8 @@ func (c *Manager) recvScoreMsg(ctx context.Context, smchan chan ScoreMsg) error
 					}
 				}
 			} else {
-				c.AddScore(s.st.Score())
+				c.AddScore(c.scoreconf.Score(s.st))
+				c.windows.add(time.Now(), c.scoreconf.Score(s.st))
 				c.scoreboard.Add(s.st)
 				if s.sns {
 					if e := c.startScenarios(ctx, smchan, AddUsersOnShare); e != nil {
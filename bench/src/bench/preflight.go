@@ -0,0 +1,73 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPreflight は負荷走行の前の疎通確認に失敗した endpoint です
+type ErrPreflight struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *ErrPreflight) Error() string {
+	return fmt.Sprintf("%s の疎通確認に失敗しました: %s", e.Endpoint, e.Err)
+}
+
+// Preflight は負荷走行の前に app の主要な endpoint と isubank を1回ずつ叩き、
+// status, Content-Type と body の形が正しいかを確認します
+// 落ちている endpoint があるまま負荷走行をして 0 点になるのを避けるためです
+func (c *Manager) Preflight(ctx context.Context) error {
+	if _, err := c.isubank.Time(); err != nil {
+		return &ErrPreflight{"isubank GET /time", err}
+	}
+	for _, target := range c.targets {
+		guest, err := NewClient(target, "", "", "", initTimeout, initTimeout)
+		if err != nil {
+			return err
+		}
+		if err := guest.preflight(ctx, "/", "text/html", nil); err != nil {
+			return &ErrPreflight{fmt.Sprintf("GET / (%s)", target), err}
+		}
+		info := &InfoResponse{}
+		if err := guest.preflight(ctx, "/info?cursor=0", "application/json", info); err != nil {
+			return &ErrPreflight{fmt.Sprintf("GET /info (%s)", target), err}
+		}
+		log.Printf("[INFO] preflight %s ok", target)
+	}
+	return nil
+}
+
+// preflight は path を GET して 200 と mediaType を確認し、v が nil でなければ JSON として読みます
+func (c *Client) preflight(ctx context.Context, path, mediaType string, v interface{}) error {
+	res, err := c.get(ctx, path, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "body read failed")
+	}
+	if res.StatusCode != 200 {
+		return errorWithStatus(errors.New("unexpected status"), res.StatusCode, string(b))
+	}
+	ct := res.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != mediaType {
+		return errors.Errorf("unexpected Content-Type %q (want %s)", ct, mediaType)
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			return errors.Wrap(err, "body decode failed")
+		}
+	}
+	return nil
+}
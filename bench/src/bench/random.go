@@ -1,10 +1,47 @@
 package bench
 
 import (
+	"log"
+	"math/rand"
+	"sync"
+
 	"github.com/Songmu/strrand"
 	"bench/randnameja"
 )
 
+var seed int64 = 1
+
+// Seed は Manager が使う乱数の seed を設定します。各シナリオは seed にシナリオの番号を足した seed を使います
+// strrand や randnameja は math/rand の global を使うのでそちらも同じ seed にしますが、
+// 全シナリオで共有されるので生成されるユーザー名やパスワードは goroutine の実行順によって変わります
+func Seed(s int64) {
+	seed = s
+	rand.Seed(s)
+	log.Printf("[INFO] seed %d", s)
+}
+
+// lockedSource は複数のシナリオから同時に使えるように rand.Source を lock します
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func newLockedSource(s int64) *lockedSource {
+	return &lockedSource{src: rand.NewSource(s)}
+}
+
+func (r *lockedSource) Int63() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.src.Int63()
+}
+
+func (r *lockedSource) Seed(s int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.src.Seed(s)
+}
+
 type Random struct {
 	passGen strrand.Generator
 	idGen   strrand.Generator
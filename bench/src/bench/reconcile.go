@@ -0,0 +1,94 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// ErrReconcile は成立した取引の金額が銀行の残高の履歴に無いことを表します
+type ErrReconcile struct {
+	UserID  int64
+	OrderID int64
+	TradeID int64
+	Amount  int64
+}
+
+func (e *ErrReconcile) Error() string {
+	return fmt.Sprintf("取引が銀行で確定されていません [user_id:%d, order_id:%d, trade_id:%d, amount:%d]", e.UserID, e.OrderID, e.TradeID, e.Amount)
+}
+
+// Reconcile は負荷走行で成立した取引が銀行で実際に確定しているかを確認します
+// 取引が成立したユーザーから ReconcileSampleUsers 人を選び、isubank の credit_history に
+// 各取引の金額 (買いは -price*amount, 売りは +price*amount) があるかを照合します
+func (c *Manager) Reconcile(ctx context.Context) error {
+	c.scenarioLock.Lock()
+	targets := make([]*normalScenario, 0, len(c.scenarios))
+	for _, sc := range c.scenarios {
+		if s, ok := sc.(*normalScenario); ok && s.tradedCount() > 0 {
+			targets = append(targets, s)
+		}
+	}
+	c.scenarioLock.Unlock()
+
+	c.rng.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	if len(targets) > ReconcileSampleUsers {
+		targets = targets[:ReconcileSampleUsers]
+	}
+	for _, s := range targets {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if err := c.reconcileScenario(s); err != nil {
+			return err
+		}
+	}
+	log.Printf("[INFO] reconciled %d users", len(targets))
+	return nil
+}
+
+func (c *Manager) reconcileScenario(s *normalScenario) error {
+	credits, err := c.isubank.CreditHistory(s.BankID(), ReconcileHistoryLimit)
+	if err != nil {
+		// 銀行側の問題なので参加者のエラーにはしない
+		log.Printf("[WARN] reconcile skipped. bankid:%s, err:%s", s.BankID(), err)
+		return nil
+	}
+	amounts := make(map[int64]int, len(credits))
+	for _, credit := range credits {
+		amounts[credit.Amount]++
+	}
+
+	s.ordersLock.Lock()
+	defer s.ordersLock.Unlock()
+	for _, o := range s.orders {
+		if o.TradeID == 0 || o.Trade == nil {
+			continue
+		}
+		amount := o.Amount * o.Trade.Price
+		if o.Type == TradeTypeBuy {
+			amount = -amount
+		}
+		if amounts[amount] == 0 {
+			return &ErrReconcile{s.UserID(), o.ID, o.TradeID, amount}
+		}
+		amounts[amount]--
+	}
+	return nil
+}
+
+func (s *normalScenario) tradedCount() int {
+	s.ordersLock.Lock()
+	defer s.ordersLock.Unlock()
+	n := 0
+	for _, o := range s.orders {
+		if o.TradeID > 0 {
+			n++
+		}
+	}
+	return n
+}
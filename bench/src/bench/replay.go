@@ -0,0 +1,171 @@
+package bench
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ReplayResult は -replay の結果です
+type ReplayResult struct {
+	Total      int          `json:"total"`
+	Mismatches int          `json:"mismatches"`
+	Diffs      []ReplayDiff `json:"diffs"`
+}
+
+// ReplayDiff は記録と違うレスポンスになったリクエストです
+// status が同じでも body が違えば BodyChanged になります
+type ReplayDiff struct {
+	Line        int    `json:"line"`
+	Client      string `json:"client"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Recorded    int    `json:"recorded_status"`
+	Got         int    `json:"status"`
+	BodyChanged bool   `json:"body_changed"`
+	Error       string `json:"error,omitempty"`
+}
+
+// replayOp は送り直すリクエストです
+// 5xx やエラーで Client が retry した場合は、最後の retry の記録を final に持ちます
+type replayOp struct {
+	line  int
+	op    *requestTrace
+	final *requestTrace
+}
+
+// Replay は -trace-sample=1 で記録したリクエストを記録した順に target に1つずつ送り直し、status か body が記録と違うものを返します
+// ユーザー(bank_id)ごとに Client を分けるので、session の cookie も記録時と同じように引き継がれます
+func Replay(ctx context.Context, path, target string) (*ReplayResult, error) {
+	ops, err := readReplayOps(path)
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]*Client, 100)
+	result := &ReplayResult{Diffs: []ReplayDiff{}}
+	for _, ro := range ops {
+		op := ro.op
+		c, ok := clients[op.Client]
+		if !ok {
+			if c, err = NewClient(target, op.Client, "", "", clientTimeout, RetireTimeout); err != nil {
+				return result, err
+			}
+			clients[op.Client] = c
+		}
+		result.Total++
+		status, hash, err := c.replay(ctx, op)
+		// body の hash を記録していない古い trace では status だけ比べる
+		bodyChanged := ro.final.BodyMD5 != "" && hash != ro.final.BodyMD5
+		if status == ro.final.Status && !bodyChanged {
+			continue
+		}
+		d := ReplayDiff{
+			Line:        ro.line,
+			Client:      op.Client,
+			Method:      op.Method,
+			Path:        requestURI(op.URL),
+			Recorded:    ro.final.Status,
+			Got:         status,
+			BodyChanged: bodyChanged,
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		log.Printf("[INFO] replay line:%d %s %s [client:%s] status:%d (recorded:%d) body_changed:%v %s", d.Line, d.Method, d.Path, d.Client, d.Got, d.Recorded, d.BodyChanged, d.Error)
+		result.Mismatches++
+		result.Diffs = append(result.Diffs, d)
+	}
+	return result, nil
+}
+
+// readReplayOps は trace を読み、Client の retry の記録を最初のリクエストにまとめます
+// 送り直した時の retry は Client に任せるためです
+// 並行するユーザーの記録は交互に並ぶので、直前の行ではなく Client ごとに最後に失敗したリクエストと比べます
+func readReplayOps(path string) ([]*replayOp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open replay file failed")
+	}
+	defer f.Close()
+
+	ops := []*replayOp{}
+	failed := make(map[string]*replayOp, 100)
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "read replay file failed")
+		}
+		op := &requestTrace{}
+		if err := json.Unmarshal(b, op); err != nil {
+			return nil, errors.Wrapf(err, "parse replay file failed. line:%d", line)
+		}
+		ro, ok := failed[op.Client]
+		if ok && sameRequest(ro.op, op) {
+			ro.final = op
+		} else {
+			ro = &replayOp{line: line, op: op, final: op}
+			ops = append(ops, ro)
+		}
+		if op.Status == 0 || op.Status >= 500 {
+			failed[op.Client] = ro
+		} else {
+			delete(failed, op.Client)
+		}
+	}
+	return ops, nil
+}
+
+func sameRequest(a, b *requestTrace) bool {
+	return a.Client == b.Client && a.Method == b.Method && a.URL == b.URL && a.Body == b.Body
+}
+
+// requestURI は記録した URL の host を除いた部分です
+func requestURI(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.RequestURI()
+}
+
+// replay は記録したリクエストを通常の doRequest で送り、status と body の hash を返します
+func (c *Client) replay(ctx context.Context, op *requestTrace) (int, string, error) {
+	u, err := c.base.Parse(requestURI(op.URL))
+	if err != nil {
+		return 0, "", errors.Wrap(err, "url parse failed")
+	}
+	var body io.Reader
+	if op.Body != "" {
+		body = strings.NewReader(op.Body)
+	}
+	req, err := http.NewRequest(op.Method, u.String(), body)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "new request failed")
+	}
+	if op.Body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	res, err := c.doRequest(ctx, req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, "", errors.Wrap(err, "body read failed")
+	}
+	return res.StatusCode, bodyMD5(b), nil
+}
@@ -0,0 +1,201 @@
+package bench
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"bench/isubank"
+)
+
+// ReserveCommitResult は予約されてから確定されるまでの時間の分布です
+type ReserveCommitResult struct {
+	Committed int64   `json:"committed"`
+	Canceled  int64   `json:"canceled"`
+	Expired   int64   `json:"expired"`
+	Risky     int64   `json:"risky"` // 期限まで ReserveRiskyMargin 未満で確定した数
+	P50       float64 `json:"p50_ms"`
+	P95       float64 `json:"p95_ms"`
+	P99       float64 `json:"p99_ms"`
+	Max       float64 `json:"max_ms"`
+}
+
+// reserveWatch は負荷走行中に一部のユーザーの銀行の予約を見て、予約されてから確定されるまでの時間を調べます
+// 予約は app が銀行に作るので bench は reserve_id を直接受け取れません
+// そのため銀行の /reserves に予約が現れた時刻を予約された時刻とし、消えた予約を credit_history の
+// 同じ amount と note の記録と突き合わせて確定された時刻にします。見つからなければ取り消されたものとします
+type reserveWatch struct {
+	users map[string]*watchedUser
+	ids   []string
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	committed int64
+	canceled  int64
+	expired   int64
+	risky     int64
+}
+
+type watchedUser struct {
+	seen map[int64]seenReserve
+	used map[int64]bool // 突き合わせに使った credit の ID
+}
+
+type seenReserve struct {
+	isubank.ActiveReserve
+	at time.Time // 最初に見えた銀行の時刻
+}
+
+func newReserveWatch() *reserveWatch {
+	return &reserveWatch{
+		users: make(map[string]*watchedUser, ReserveWatchUsers),
+	}
+}
+
+// runReserveWatch は ReserveWatchInterval ごとに signin 済みのユーザーから ReserveWatchUsers 人の予約を見に行きます
+func (c *Manager) runReserveWatch(ctx context.Context) {
+	// 予約の期限と credit の created_at は銀行の時刻なので、最初にずれを測っておく
+	bankNow, err := c.isubank.Time()
+	if err != nil {
+		log.Printf("[WARN] reserve watch disabled. err: %s", err)
+		return
+	}
+	offset := bankNow.Sub(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-time.After(ReserveWatchInterval):
+		}
+		c.scenarioLock.Lock()
+		for _, sc := range c.scenarios {
+			if len(c.reserves.ids) >= ReserveWatchUsers {
+				break
+			}
+			if s, ok := sc.(*normalScenario); ok && s.IsSignin() {
+				c.reserves.watch(s.BankID())
+			}
+		}
+		c.scenarioLock.Unlock()
+		for _, id := range c.reserves.ids {
+			c.reserves.poll(c.isubank, id, time.Now().Add(offset))
+		}
+	}
+}
+
+func (w *reserveWatch) watch(bankID string) {
+	if _, ok := w.users[bankID]; ok {
+		return
+	}
+	w.users[bankID] = &watchedUser{
+		seen: make(map[int64]seenReserve, 10),
+		used: make(map[int64]bool, 10),
+	}
+	w.ids = append(w.ids, bankID)
+}
+
+func (w *reserveWatch) poll(bank *isubank.Isubank, bankID string, now time.Time) {
+	reserves, err := bank.Reserves(bankID)
+	if err != nil {
+		// 銀行側の問題なので参加者のエラーにはしない
+		log.Printf("[INFO] reserve watch skipped. bankid:%s, err:%s", bankID, err)
+		return
+	}
+	u := w.users[bankID]
+	active := make(map[int64]bool, len(reserves))
+	for _, r := range reserves {
+		active[r.ID] = true
+		if _, ok := u.seen[r.ID]; !ok {
+			u.seen[r.ID] = seenReserve{r, now}
+		}
+	}
+	gone := []seenReserve{}
+	for id, sr := range u.seen {
+		if !active[id] {
+			gone = append(gone, sr)
+			delete(u.seen, id)
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+	credits, err := bank.CreditHistory(bankID, ReconcileHistoryLimit)
+	if err != nil {
+		log.Printf("[INFO] reserve watch skipped. bankid:%s, err:%s", bankID, err)
+		return
+	}
+	for _, sr := range gone {
+		w.resolve(bankID, u, sr, credits, now)
+	}
+}
+
+func (w *reserveWatch) resolve(bankID string, u *watchedUser, sr seenReserve, credits []isubank.Credit, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// credits は新しい順なので、古い方から予約が見えた後の記録を探す
+	for i := len(credits) - 1; i >= 0; i-- {
+		c := credits[i]
+		if u.used[c.ID] || c.Amount != sr.Amount || c.Note != sr.Note || c.CreatedAt.Before(sr.at.Add(-ReserveWatchInterval)) {
+			continue
+		}
+		u.used[c.ID] = true
+		d := c.CreatedAt.Sub(sr.at)
+		if d < 0 {
+			d = 0
+		}
+		w.latencies = append(w.latencies, d)
+		w.committed++
+		if rest := sr.ExpireAt.Sub(c.CreatedAt); rest < ReserveRiskyMargin {
+			w.risky++
+			log.Printf("[INFO] risky commit. bankid:%s, reserve_id:%d, %s before expiry", bankID, sr.ID, rest)
+		}
+		return
+	}
+	if now.Before(sr.ExpireAt) {
+		w.canceled++
+	} else {
+		w.expired++
+	}
+}
+
+// Result は reserveWatch が nil の場合は nil を返します
+func (w *reserveWatch) Result() *ReserveCommitResult {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := &ReserveCommitResult{
+		Committed: w.committed,
+		Canceled:  w.canceled,
+		Expired:   w.expired,
+		Risky:     w.risky,
+	}
+	if len(w.latencies) == 0 {
+		return r
+	}
+	ls := make([]time.Duration, len(w.latencies))
+	copy(ls, w.latencies)
+	sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+	pct := func(p int) float64 {
+		i := (len(ls)*p+99)/100 - 1
+		return float64(ls[i]) / float64(time.Millisecond)
+	}
+	r.P50, r.P95, r.P99 = pct(50), pct(95), pct(99)
+	r.Max = float64(ls[len(ls)-1]) / float64(time.Millisecond)
+	return r
+}
+
+// Dump は予約から確定までの時間をログに出します
+func (w *reserveWatch) Dump() {
+	r := w.Result()
+	if r == nil {
+		return
+	}
+	log.Printf("[INFO] reserve to commit: committed=%d, canceled=%d, expired=%d, risky=%d, p50=%.0fms, p95=%.0fms, p99=%.0fms, max=%.0fms",
+		r.Committed, r.Canceled, r.Expired, r.Risky, r.P50, r.P95, r.P99, r.Max)
+}
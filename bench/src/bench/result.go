@@ -0,0 +1,208 @@
+package bench
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Result は -output=json で出力する集計結果です
+type Result struct {
+	Pass       bool                      `json:"pass"`
+	Score      int64                     `json:"score"`
+	Level      int                       `json:"level"`
+	Message    string                    `json:"message"`
+	Operations map[string]int64          `json:"operations"` // 成功した操作ごとの件数
+	Errors     map[string]int            `json:"errors"`     // エラーの種類ごとの件数
+	Endpoints  map[string]EndpointResult `json:"endpoints"`
+	Targets    map[string]TargetResult   `json:"targets"`  // -targets の host ごとのリクエスト数
+	Backoffs   int64                     `json:"backoffs"` // 503 Retry-After に従って待った回数
+	Duration   float64                   `json:"duration"` // 負荷走行の実際の時間(秒)
+	RPS        float64                   `json:"rps"`      // 負荷走行中の app への実際のリクエスト数/秒
+	Soak       *SoakResult               `json:"soak,omitempty"`
+	BankRetry  int64                     `json:"bank_retries"` // isubank へのリクエストを retry した回数
+	// -weights で実際に選ばれた行動ごとの回数
+	Actions map[string]int64 `json:"actions,omitempty"`
+	// Ctrl-C で中断した途中までの結果の場合に true
+	Aborted bool `json:"aborted"`
+	// 負荷走行が終了した理由 (duration|max-requests|aborted|error|critical)
+	StopReason string `json:"stop_reason"`
+	// 一部のユーザーの予約が確定されるまでの時間
+	ReserveCommit *ReserveCommitResult `json:"reserve_commit,omitempty"`
+	// ユーザーごとのスループットの偏り
+	Fairness *FairnessResult `json:"fairness,omitempty"`
+}
+
+type EndpointResult struct {
+	Success int64   `json:"success"`
+	Fail    int64   `json:"fail"`
+	P50     float64 `json:"p50_ms"`
+	P95     float64 `json:"p95_ms"`
+	P99     float64 `json:"p99_ms"`
+}
+
+type TargetResult struct {
+	Success int64 `json:"success"`
+	Fail    int64 `json:"fail"`
+}
+
+type endpointStat struct {
+	success   int64
+	fail      int64
+	latencies *latencyHistogram
+}
+
+// latencyHistogram は 1ms 刻みで -client-timeout までのレイテンシを数えます
+// それを超えたものは最後の bucket に入れます
+type latencyHistogram struct {
+	buckets []int64
+	total   int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{
+		buckets: make([]int64, int(clientTimeout/time.Millisecond)+1),
+	}
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	i := int(d / time.Millisecond)
+	if i < 0 {
+		i = 0
+	} else if i >= len(h.buckets) {
+		i = len(h.buckets) - 1
+	}
+	h.buckets[i]++
+	h.total++
+}
+
+// percentile は p パーセンタイルをミリ秒で返します
+func (h *latencyHistogram) percentile(p int) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := (h.total*int64(p) + 99) / 100
+	var n int64
+	for i, c := range h.buckets {
+		n += c
+		if n >= rank {
+			return float64(i)
+		}
+	}
+	return float64(len(h.buckets) - 1)
+}
+
+// requestStats は Client のリクエストを endpoint ごとに集計します
+// Client はいろいろな所で作られるので package で1つ持ちます
+var requestStats = &endpointStats{
+	stats:   make(map[string]*endpointStat, 20),
+	targets: make(map[string]*TargetResult, 4),
+}
+
+type endpointStats struct {
+	mu       sync.Mutex
+	stats    map[string]*endpointStat
+	targets  map[string]*TargetResult
+	backoffs int64
+}
+
+func (s *endpointStats) backoff() {
+	atomic.AddInt64(&s.backoffs, 1)
+}
+
+func (s *endpointStats) Backoffs() int64 {
+	return atomic.LoadInt64(&s.backoffs)
+}
+
+var idPathRe = regexp.MustCompile(`/[0-9]+`)
+
+func (s *endpointStats) record(req *http.Request, statusCode int, elapsed time.Duration) {
+	endpoint := req.Method + " " + idPathRe.ReplaceAllString(req.URL.Path, "/:id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.stats[endpoint]
+	if !ok {
+		st = &endpointStat{latencies: newLatencyHistogram()}
+		s.stats[endpoint] = st
+	}
+	tr, ok := s.targets[req.URL.Host]
+	if !ok {
+		tr = &TargetResult{}
+		s.targets[req.URL.Host] = tr
+	}
+	if 0 < statusCode && statusCode < 400 {
+		st.success++
+		tr.Success++
+	} else {
+		st.fail++
+		tr.Fail++
+	}
+	st.latencies.add(elapsed)
+}
+
+// total はこれまでのリクエスト数です
+func (s *endpointStats) total() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, st := range s.stats {
+		n += st.success + st.fail
+	}
+	return n
+}
+
+func (s *endpointStats) targetResults() map[string]TargetResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make(map[string]TargetResult, len(s.targets))
+	for host, tr := range s.targets {
+		r[host] = *tr
+	}
+	return r
+}
+
+func (s *endpointStats) results() map[string]EndpointResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make(map[string]EndpointResult, len(s.stats))
+	for endpoint, st := range s.stats {
+		r[endpoint] = EndpointResult{
+			Success: st.success,
+			Fail:    st.fail,
+			P50:     st.latencies.percentile(50),
+			P95:     st.latencies.percentile(95),
+			P99:     st.latencies.percentile(99),
+		}
+	}
+	return r
+}
+
+// Dump は endpoint ごとのレイテンシを ScoreBoard.Dump と同じようにログに出します
+func (s *endpointStats) Dump() {
+	r := s.results()
+	endpoints := make([]string, 0, len(r))
+	for endpoint := range r {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		e := r[endpoint]
+		log.Printf("[INFO] %-24s: success=%d, fail=%d, p50=%.0fms, p95=%.0fms, p99=%.0fms", endpoint, e.Success, e.Fail, e.P50, e.P95, e.P99)
+	}
+	targets := s.targetResults()
+	if len(targets) > 1 {
+		hosts := make([]string, 0, len(targets))
+		for host := range targets {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			log.Printf("[INFO] target %-24s: success=%d, fail=%d", host, targets[host].Success, targets[host].Fail)
+		}
+	}
+	log.Printf("[INFO] backoff by Retry-After: count=%d", s.Backoffs())
+}
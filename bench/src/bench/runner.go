@@ -2,27 +2,60 @@ package bench
 
 import (
 	"context"
+	"log"
+	"sync"
 	"time"
 
 	"bench/portal"
 	"github.com/pkg/errors"
 )
 
+// 負荷走行が終了した理由です
+const (
+	StopReasonDuration    = "duration"     // -duration が経過した
+	StopReasonMaxRequests = "max-requests" // -max-requests に達した
+	StopReasonAborted     = "aborted"      // Ctrl-C で中断した
+	StopReasonError       = "error"        // エラーが多すぎて打ち切った
+	StopReasonCritical    = "critical"     // -fail-fast で致命的なエラーが起きた
+)
+
+// ErrAborted は Abort で負荷走行を中断した時に Run が返すエラーです
+var ErrAborted = errors.New("ABORTED: 負荷走行を中断しました")
+
 type Runner struct {
 	mgr   *Manager
 	done  chan struct{}
 	start time.Time
 	end   time.Time
 	fail  bool
+
+	abort      chan struct{}
+	abortOnce  sync.Once
+	aborted    bool
+	stopReason string
+
+	loadStart time.Time
+	loadEnd   time.Time
+	// 負荷走行中の app へのリクエスト数
+	loadRequests int64
 }
 
 func NewRunner(mgr *Manager) *Runner {
 	return &Runner{
-		mgr:  mgr,
-		done: make(chan struct{}),
+		mgr:   mgr,
+		done:  make(chan struct{}),
+		abort: make(chan struct{}),
 	}
 }
 
+// Abort は負荷走行を中断します
+// 新しい操作を止めて AbortDrainTimeout まで実行中のリクエストを待ち、それまでの結果で終了します
+func (r *Runner) Abort() {
+	r.abortOnce.Do(func() {
+		close(r.abort)
+	})
+}
+
 func (r *Runner) Result() portal.BenchResult {
 	score := r.mgr.FinalScore()
 	if r.fail {
@@ -31,7 +64,9 @@ func (r *Runner) Result() portal.BenchResult {
 	}
 	level := r.mgr.GetLevel()
 	errors := r.mgr.GetErrorsString()
-	if score > 0 {
+	if r.aborted {
+		r.mgr.Logger().Printf("ABORTED => Score: %d, (level: %d, errors: %d, users: %d/%d)", score, level, r.mgr.ErrorCount(), r.mgr.ActiveUsers(), r.mgr.AllUsers())
+	} else if score > 0 {
 		r.mgr.Logger().Printf("Pass => Score: %d, (level: %d, errors: %d, users: %d/%d)", score, level, r.mgr.ErrorCount(), r.mgr.ActiveUsers(), r.mgr.AllUsers())
 	} else {
 		r.mgr.Logger().Printf("Fail => Score: %d, (level: %d, errors: %d, users: %d/%d, score:%d)", score, level, r.mgr.ErrorCount(), r.mgr.ActiveUsers(), r.mgr.AllUsers(), r.mgr.TotalScore())
@@ -50,6 +85,34 @@ func (r *Runner) Result() portal.BenchResult {
 	}
 }
 
+// DetailResult は -output=json 用に操作ごと、endpointごとの集計を含めた結果を返します
+func (r *Runner) DetailResult() Result {
+	score := r.mgr.FinalScore()
+	if r.fail {
+		score = 0
+	}
+	return Result{
+		Pass:       score > 0,
+		Score:      score,
+		Level:      int(r.mgr.GetLevel()),
+		Operations: r.mgr.scoreboard.Counts(),
+		Errors:     r.mgr.ErrorsByType(),
+		Endpoints:  requestStats.results(),
+		Targets:    requestStats.targetResults(),
+		Backoffs:   requestStats.Backoffs(),
+		BankRetry:  r.mgr.BankRetries(),
+		Duration:   r.LoadDuration().Seconds(),
+		RPS:        r.RPS(),
+		Soak:       r.mgr.SoakResult(r.loadEnd),
+		Aborted:    r.aborted,
+		StopReason: r.stopReason,
+		Actions:    actionWeights.ActionCounts(),
+
+		ReserveCommit: r.mgr.reserves.Result(),
+		Fairness:      userStats.result(),
+	}
+}
+
 func (r *Runner) Run(ctx context.Context) error {
 	m := r.mgr
 	defer func() {
@@ -66,6 +129,11 @@ func (r *Runner) Run(ctx context.Context) error {
 		return errors.Wrap(err, "Initialize に失敗しました")
 	}
 
+	m.Logger().Println("# preflight")
+	if err := m.Preflight(cctx); err != nil {
+		return errors.Wrap(err, "負荷走行前の疎通確認に失敗しました")
+	}
+
 	m.Logger().Println("# pre test")
 	if err := m.PreTest(cctx); err != nil {
 		return errors.Wrap(err, "負荷走行前のテストに失敗しました")
@@ -78,10 +146,29 @@ func (r *Runner) Run(ctx context.Context) error {
 		return errors.Wrap(err, "負荷走行 に失敗しました")
 	}
 	m.scoreboard.Dump()
+	requestStats.Dump()
+	actionWeights.Dump()
+	m.reserves.Dump()
+	r.reportFairness()
+	log.Printf("[INFO] isubank retries: count=%d", m.BankRetries())
+	for et, count := range m.ErrorsByType() {
+		log.Printf("[INFO] error %-20s: count=%d", et, count)
+	}
+	r.reportSoak()
 
 	if r.fail {
 		return errors.New("finish by fail")
 	}
+	if r.aborted {
+		// 中断した時は途中の状態なので照合と事後テストはしない
+		return ErrAborted
+	}
+
+	m.Logger().Printf("# reconcile")
+	if err := m.Reconcile(cctx); err != nil {
+		r.fail = true
+		return errors.Wrap(err, "取引と銀行の照合に失敗しました")
+	}
 
 	// cancelたちが終わるように少し待つ(すべての状態管理はつらすぎるので)
 	time.Sleep(50 * time.Millisecond)
@@ -95,13 +182,185 @@ func (r *Runner) Run(ctx context.Context) error {
 	return nil
 }
 
+// Validate は負荷走行をせずに初期化と事前テスト、各シナリオ1回ずつの検証だけを行います
+func (r *Runner) Validate(ctx context.Context) error {
+	m := r.mgr
+	defer func() {
+		r.end = time.Now()
+	}()
+	r.start = time.Now()
+
+	cctx, ccancel := context.WithCancel(ctx)
+	defer ccancel()
+	go m.RunIDFetcher(cctx)
+
+	m.Logger().Println("# initialize")
+	if err := m.Initialize(cctx); err != nil {
+		r.fail = true
+		return errors.Wrap(err, "Initialize に失敗しました")
+	}
+
+	m.Logger().Println("# pre test")
+	if err := m.PreTest(cctx); err != nil {
+		r.fail = true
+		return errors.Wrap(err, "負荷走行前のテストに失敗しました")
+	}
+
+	m.Logger().Println("# validate scenarios")
+	failed := 0
+	for _, res := range m.ValidateScenarios(cctx) {
+		if res.Err != nil {
+			failed++
+			m.Logger().Printf("%-12s: fail (%s)", res.Scenario, res.Err)
+		} else {
+			m.Logger().Printf("%-12s: pass", res.Scenario)
+		}
+	}
+	if failed > 0 {
+		r.fail = true
+		return errors.Errorf("%d シナリオの検証に失敗しました", failed)
+	}
+	return nil
+}
+
+// reportSoak は -soak の window ごとの得点と、peak からの劣化をログに出します
+func (r *Runner) reportSoak() {
+	sr := r.mgr.SoakResult(r.loadEnd)
+	if sr == nil {
+		return
+	}
+	for i, s := range sr.Scores {
+		mark := ""
+		if i == sr.Peak {
+			mark = " (peak)"
+		}
+		r.mgr.Logger().Printf("window %3d: score=%d%s", i, s, mark)
+	}
+	if len(sr.Regressed) > 0 {
+		r.mgr.Logger().Printf("警告: peak 以降に %d window で得点が %.0f%% を下回りました %v", len(sr.Regressed), r.mgr.threshold*100, sr.Regressed)
+	}
+}
+
+// reportFairness はユーザーごとのスループットの偏りを出力し、偏りすぎていれば警告します
+func (r *Runner) reportFairness() {
+	f := userStats.result()
+	if f == nil {
+		return
+	}
+	log.Printf("[INFO] fairness: users=%d, rps=%.2f-%.2f (ratio %.2f), avg latency=%.0fms-%.0fms", f.Users, f.MinRPS, f.MaxRPS, f.Ratio, f.MinLatency, f.MaxLatency)
+	if f.Unfair {
+		r.mgr.Logger().Printf("警告: ユーザーによって処理の速さが偏っています。一番遅いユーザー(%s)のスループットは一番速いユーザーの %.0f%% です", f.SlowestUser, f.Ratio*100)
+	}
+}
+
+// BankCheck は負荷走行をせずに isubank の並行 commit の正しさだけを確認します
+// expiry の場合は予約の期限と放置された予約の確認もします。gc の場合は放置された予約が削除されるまで待ちます
+func (r *Runner) BankCheck(ctx context.Context, expiry, gc bool) error {
+	m := r.mgr
+	defer func() {
+		r.end = time.Now()
+	}()
+	r.start = time.Now()
+
+	cctx, ccancel := context.WithCancel(ctx)
+	defer ccancel()
+	go m.RunIDFetcher(cctx)
+
+	m.Logger().Println("# bank check")
+	if err := m.BankCheck(cctx); err != nil {
+		r.fail = true
+		return errors.Wrap(err, "銀行の並行 commit の確認に失敗しました")
+	}
+	if !expiry {
+		return nil
+	}
+	m.Logger().Println("# bank expiry check")
+	// どちらも -reserve-ttl だけ待つので並行して確認する
+	abandon := make(chan error, 1)
+	go func() {
+		abandon <- m.BankAbandonCheck(cctx, gc)
+	}()
+	if err := m.BankExpiryCheck(cctx); err != nil {
+		r.fail = true
+		return errors.Wrap(err, "銀行の予約の期限の確認に失敗しました")
+	}
+	if err := <-abandon; err != nil {
+		r.fail = true
+		return errors.Wrap(err, "銀行の放置された予約の確認に失敗しました")
+	}
+	return nil
+}
+
+// LoadDuration は実際に負荷走行をした時間です
+func (r *Runner) LoadDuration() time.Duration {
+	if r.loadStart.IsZero() || r.loadEnd.IsZero() {
+		return 0
+	}
+	return r.loadEnd.Sub(r.loadStart)
+}
+
+// RPS は負荷走行中の app への実際のリクエスト数/秒です。-think-time の影響はここに表れます
+func (r *Runner) RPS() float64 {
+	d := r.LoadDuration()
+	if d <= 0 {
+		return 0
+	}
+	return float64(r.loadRequests) / d.Seconds()
+}
+
 func (r *Runner) runScenarioBenchmark(ctx context.Context) error {
-	cctx, cancel := context.WithTimeout(ctx, BenchMarkTime)
+	cctx, cancel := context.WithTimeout(ctx, benchMarkTime)
 	defer cancel()
 
+	r.loadStart = time.Now()
+	startRequests := requestStats.total()
+	defer func() {
+		r.loadEnd = time.Now()
+		r.loadRequests = requestStats.total() - startRequests
+		r.mgr.Logger().Printf("負荷走行時間: %.3fs", r.LoadDuration().Seconds())
+		log.Printf("[INFO] effective rps: %.1f (requests: %d, think time: %s +-%s)", r.RPS(), r.loadRequests, thinkTime, thinkJitter)
+	}()
+
+	requestBudget.start()
+	defer requestBudget.stop()
+	userStats.start()
+	defer userStats.stop()
+	stopped := make(chan string, 1)
+	go func() {
+		select {
+		case <-cctx.Done():
+			return
+		case <-r.abort:
+			stopped <- StopReasonAborted
+			r.mgr.Logger().Printf("中断します。実行中のリクエストを最大 %s 待ちます", AbortDrainTimeout)
+		case <-requestBudget.exhausted():
+			stopped <- StopReasonMaxRequests
+			r.mgr.Logger().Printf("リクエスト数が上限に達したので終了します。実行中のリクエストを最大 %s 待ちます", AbortDrainTimeout)
+		}
+		r.mgr.Stop()
+		select {
+		case <-cctx.Done():
+		case <-time.After(AbortDrainTimeout):
+		}
+		cancel()
+	}()
+
 	err := r.mgr.ScenarioStart(cctx)
 	if err == context.DeadlineExceeded {
 		err = nil
 	}
+	select {
+	case r.stopReason = <-stopped:
+	default:
+		r.stopReason = StopReasonDuration
+		if err != nil {
+			r.stopReason = StopReasonError
+		}
+		if r.mgr.Critical() != nil {
+			r.stopReason = StopReasonCritical
+		}
+	}
+	r.aborted = r.stopReason == StopReasonAborted
+	r.mgr.Logger().Printf("負荷走行の終了理由: %s", r.stopReason)
 	return err
 }
@@ -18,10 +18,39 @@ type Scenario interface {
 	IsRetired() bool
 	BankID() string
 	Credit() int64
+
+	setStop(<-chan struct{})
 }
 
 type baseScenario struct {
-	c *Client
+	c   *Client
+	rnd *rand.Rand
+
+	// stop が close されたら新しい操作を始めずに終了します
+	stop <-chan struct{}
+}
+
+func (s *baseScenario) setStop(stop <-chan struct{}) {
+	s.stop = stop
+}
+
+// think は -think-time の間だけ待ちます。その間に終了した場合は false を返します
+func (s *baseScenario) think(ctx context.Context) bool {
+	if thinkTime <= 0 {
+		return true
+	}
+	d := thinkTime
+	if thinkJitter > 0 {
+		d += time.Duration(s.rnd.Int63n(int64(thinkJitter)*2+1)) - thinkJitter
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-s.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
 func (s *baseScenario) IsSignin() bool {
@@ -57,6 +86,7 @@ type normalScenario struct {
 	enableShare      bool
 	orders           []*Order
 	ordersLock       sync.Mutex
+	trades           *tradeView
 
 	unitIsu        int64
 	defaultIsu     int64
@@ -70,28 +100,30 @@ type normalScenario struct {
 	existed    bool
 	ignoretest bool
 	justprice  bool
+	bySignup   bool // -weights の signup で追加されたユーザー
 }
 
-func newNormalScenario(c *Client, credit, isu, unit int64, justprice bool) *normalScenario {
+func newNormalScenario(c *Client, credit, isu, unit int64, justprice bool, rnd *rand.Rand) *normalScenario {
 	return &normalScenario{
-		baseScenario:  &baseScenario{c},
+		baseScenario:  &baseScenario{c: c, rnd: rnd},
 		defaultCredit: credit,
 		defaultIsu:    isu,
 		currentCredit: credit,
 		currentIsu:    isu,
 		unitIsu:       unit,
 		orders:        make([]*Order, 0, 60),
-		actionchan:    make(chan struct{}, BenchMarkTime/PollingInterval),
+		trades:        newTradeView(),
+		actionchan:    make(chan struct{}, benchMarkTime/pollingInterval),
 		justprice:     justprice,
 	}
 }
 
-func NewNormalScenario(c *Client, credit, isu, unit int64, justprice bool) Scenario {
-	return newNormalScenario(c, credit, isu, unit, justprice)
+func NewNormalScenario(c *Client, credit, isu, unit int64, justprice bool, rnd *rand.Rand) Scenario {
+	return newNormalScenario(c, credit, isu, unit, justprice, rnd)
 }
 
-func NewExistsUserScenario(c *Client, credit, isu, unit int64, justprice bool) Scenario {
-	s := newNormalScenario(c, credit, isu, unit, justprice)
+func NewExistsUserScenario(c *Client, credit, isu, unit int64, justprice bool, rnd *rand.Rand) Scenario {
+	s := newNormalScenario(c, credit, isu, unit, justprice, rnd)
 	s.existed = true
 	s.ignoretest = true
 	return s
@@ -125,11 +157,43 @@ func (s *normalScenario) waitingOrders() int {
 }
 
 func (s *normalScenario) Start(ctx context.Context, smchan chan ScoreMsg) error {
+	if err := s.prepare(ctx, smchan); err != nil {
+		return err
+	}
+
+	go s.runAction(ctx, smchan)
+
+	go s.runInfoLoop(ctx, smchan)
+
+	return nil
+}
+
+// runOnce は -validate 用に prepare と1回の取引を順番に実行します
+func (s *normalScenario) runOnce(ctx context.Context, smchan chan ScoreMsg) error {
+	if err := s.prepare(ctx, smchan); err != nil {
+		return err
+	}
+	st, err := s.tryTrade(ctx)
+	if st == 0 {
+		return nil
+	}
+	smchan <- ScoreMsg{st: st, err: err}
+	if err != nil {
+		return err
+	}
+	_, err = s.fetchOrders(ctx, false)
+	smchan <- ScoreMsg{st: ScoreTypeGetOrders, err: err}
+	return err
+}
+
+// prepare はトップページの表示からログインして注文履歴を取得するまでを行います
+func (s *normalScenario) prepare(ctx context.Context, smchan chan ScoreMsg) error {
 	err := s.c.Top(ctx)
 	smchan <- ScoreMsg{st: ScoreTypeGetTop, err: err}
 	if err != nil {
 		return errors.Wrap(err, "トップページを表示できません")
 	}
+	s.think(ctx)
 
 	_, _, err = s.fetchInfo(ctx, 0)
 	smchan <- ScoreMsg{st: ScoreTypeGetInfo, err: err}
@@ -137,12 +201,15 @@ func (s *normalScenario) Start(ctx context.Context, smchan chan ScoreMsg) error
 		return errors.Wrap(err, "トップページを表示できません")
 	}
 
+	s.think(ctx)
+
 	if !s.existed {
 		err = s.c.Signup(ctx)
 		smchan <- ScoreMsg{st: ScoreTypeSignup, err: err}
 		if err != nil {
 			return errors.Wrap(err, "アカウントを作成できませんでした")
 		}
+		s.think(ctx)
 	}
 
 	err = s.c.Signin(ctx)
@@ -150,17 +217,13 @@ func (s *normalScenario) Start(ctx context.Context, smchan chan ScoreMsg) error
 	if err != nil {
 		return errors.Wrap(err, "ログインできませんでした")
 	}
+	s.think(ctx)
 
 	_, err = s.fetchOrders(ctx, false)
 	smchan <- ScoreMsg{st: ScoreTypeGetOrders, err: err}
 	if err != nil {
 		return errors.Wrap(err, "注文履歴の取得に失敗しました")
 	}
-
-	go s.runAction(ctx, smchan)
-
-	go s.runInfoLoop(ctx, smchan)
-
 	return nil
 }
 
@@ -171,11 +234,13 @@ func (s *normalScenario) runInfoLoop(ctx context.Context, smchan chan ScoreMsg)
 		case <-ctx.Done():
 			handleContextErr(ctx.Err())
 			return
+		case <-s.stop:
+			return
 		default:
 			if s.c.IsRetired() {
 				return
 			}
-			nextLoopUnlock := time.After(PollingInterval)
+			nextLoopUnlock := time.After(pollingInterval)
 			next, traded, err := s.fetchInfo(ctx, cursor)
 			smchan <- ScoreMsg{st: ScoreTypeGetInfo, err: err}
 			if err != nil {
@@ -217,11 +282,23 @@ func (s *normalScenario) runAction(ctx context.Context, smchan chan ScoreMsg) {
 		case <-ctx.Done():
 			handleContextErr(ctx.Err())
 			return
+		case <-s.stop:
+			return
 		case <-s.actionchan:
 			if s.c.IsRetired() {
 				return
 			}
 			nextActionLock := time.After(OrderUpdateInterval)
+			if a := actionWeights.pick(s.rnd); a != ActionOrder {
+				if !s.runOtherAction(ctx, smchan, a) {
+					return
+				}
+				<-nextActionLock
+				if !s.think(ctx) {
+					return
+				}
+				continue
+			}
 			st, err := s.tryTrade(ctx)
 			if st == 0 {
 				continue
@@ -233,6 +310,9 @@ func (s *normalScenario) runAction(ctx context.Context, smchan chan ScoreMsg) {
 				}
 				continue
 			}
+			if !s.think(ctx) {
+				return
+			}
 			tradedOrders, err := s.fetchOrders(ctx, false)
 			smchan <- ScoreMsg{st: ScoreTypeGetOrders, err: err}
 			if err == nil {
@@ -245,6 +325,9 @@ func (s *normalScenario) runAction(ctx context.Context, smchan chan ScoreMsg) {
 				}
 			}
 			<-nextActionLock
+			if !s.think(ctx) {
+				return
+			}
 			// 取引可能状態が続くとtradeが渋滞しているはずなのでインターバルを伸ばす
 			if s.lowestSellPrice < s.highestBuyPrice {
 				gapCount++
@@ -258,12 +341,42 @@ func (s *normalScenario) runAction(ctx context.Context, smchan chan ScoreMsg) {
 	}
 }
 
+// runOtherAction は -weights で注文以外が選ばれた時の行動を行います
+// retire した場合は false を返します
+func (s *normalScenario) runOtherAction(ctx context.Context, smchan chan ScoreMsg, a Action) bool {
+	var err error
+	switch a {
+	case ActionTrades:
+		_, _, err = s.fetchInfo(ctx, 0)
+		smchan <- ScoreMsg{st: ScoreTypeGetInfo, err: err}
+	case ActionOrders:
+		var tradedOrders []*Order
+		tradedOrders, err = s.fetchOrders(ctx, false)
+		smchan <- ScoreMsg{st: ScoreTypeGetOrders, err: err}
+		for range tradedOrders {
+			smchan <- ScoreMsg{st: ScoreTypeTradeSuccess, sns: s.enableShare}
+		}
+	case ActionSignup:
+		// signup で追加されたユーザーからさらに追加するとユーザー数が指数的に増えるので何もしない
+		if !s.bySignup {
+			smchan <- ScoreMsg{signup: true}
+		}
+	}
+	if _, ok := err.(*ErrElapsedTimeOverRetire); ok {
+		return false
+	}
+	return true
+}
+
 func (s *normalScenario) fetchInfo(ctx context.Context, cursor int64) (int64, bool, error) {
 	var traded bool
 	info, err := s.c.Info(ctx, cursor)
 	if err != nil {
 		return cursor, traded, err
 	}
+	if err := s.trades.checkTraded(s.c.UserID(), "GET /info", info.TradedOrders); err != nil {
+		return cursor, traded, err
+	}
 	s.lowestSellPrice = info.LowestSellPrice
 	s.highestBuyPrice = info.HighestBuyPrice
 	s.enableShare = info.EnableShare
@@ -295,6 +408,9 @@ func (s *normalScenario) fetchOrders(ctx context.Context, skipReflectCheck bool)
 	if err != nil {
 		return nil, err
 	}
+	if err := s.trades.checkOrders(s.c.UserID(), "GET /orders", orders); err != nil {
+		return nil, err
+	}
 	if len(s.orders) > 0 && !skipReflectCheck {
 		var lo *Order
 		// cancelされていない最後の注文
@@ -377,7 +493,7 @@ func (s *normalScenario) tryTrade(ctx context.Context) (ScoreType, error) {
 	logicalCredit := s.currentCredit - s.reservedCredit
 	logicalIsu := s.currentIsu - s.reservedIsu
 	waiting := s.waitingOrders()
-	if waiting >= rand.Intn(2)+4 { // 4,5になるので 5なら100%,4なら50%
+	if waiting >= s.rnd.Intn(2)+4 { // 4,5になるので 5なら100%,4なら50%
 		var o *Order
 		var df int64
 		for _, order := range s.orders {
@@ -410,7 +526,7 @@ func (s *normalScenario) tryTrade(ctx context.Context) (ScoreType, error) {
 	var (
 		ot      string
 		price   int64 = s.latestTradePrice
-		amount  int64 = rand.Int63n(s.unitIsu) + 1
+		amount  int64 = s.rnd.Int63n(s.unitIsu) + 1
 		buyable int64
 	)
 	if s.lowestSellPrice > 0 {
@@ -419,7 +535,7 @@ func (s *normalScenario) tryTrade(ctx context.Context) (ScoreType, error) {
 		buyable = logicalCredit / s.latestTradePrice
 	}
 	// 価格は成り行き以外は前回価格からランダムに前後する
-	switch rand.Intn(5) {
+	switch s.rnd.Intn(5) {
 	case 1, 2:
 		price++
 	case 3, 4:
@@ -442,7 +558,7 @@ func (s *normalScenario) tryTrade(ctx context.Context) (ScoreType, error) {
 	case buyable < 1:
 		// 買う金が無い = 売り確定
 		ot = TradeTypeBuy
-	case rand.Intn(2) == 0:
+	case s.rnd.Intn(2) == 0:
 		ot = TradeTypeBuy
 	default:
 		ot = TradeTypeSell
@@ -481,9 +597,9 @@ type bruteForceScenario struct {
 	defpass string
 }
 
-func NewBruteForceScenario(c *Client) Scenario {
+func NewBruteForceScenario(c *Client, rnd *rand.Rand) Scenario {
 	return &bruteForceScenario{
-		baseScenario: &baseScenario{c},
+		baseScenario: &baseScenario{c: c, rnd: rnd},
 		defpass:      c.pass,
 	}
 }
@@ -498,6 +614,8 @@ func (s *bruteForceScenario) Start(ctx context.Context, smchan chan ScoreMsg) er
 			case <-ctx.Done():
 				handleContextErr(ctx.Err())
 				return
+			case <-s.stop:
+				return
 			default:
 				if s.c.IsRetired() {
 					return
@@ -531,7 +649,7 @@ func (s *bruteForceScenario) Start(ctx context.Context, smchan chan ScoreMsg) er
 					continue
 				}
 
-				s.c.pass = fmt.Sprintf("password%03d", rand.Intn(1000))
+				s.c.pass = fmt.Sprintf("password%03d", s.rnd.Intn(1000))
 				n++
 				err = s.c.Signin(ctx)
 				if err == nil {
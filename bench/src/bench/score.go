@@ -1,9 +1,13 @@
 package bench
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"sync"
+
+	"github.com/pkg/errors"
 )
 
 type ScoreType int
@@ -17,6 +21,7 @@ const (
 	ScoreTypeGetOrders
 	ScoreTypeDeleteOrders
 	ScoreTypeTradeSuccess
+	ScoreTypeSignupPersist
 )
 
 func (st ScoreType) String() string {
@@ -37,29 +42,96 @@ func (st ScoreType) String() string {
 		return "DeleteOrders"
 	case ScoreTypeTradeSuccess:
 		return "TradeSuccess"
+	case ScoreTypeSignupPersist:
+		return "SignupPersist"
 	default:
 		return fmt.Sprintf("Unknown[%d]", st)
 	}
 }
 
-func (st ScoreType) Score() int64 {
+// ScoreConfig は ScoreType ごとの得点です。指定がなければ const.go の値を使います
+type ScoreConfig struct {
+	Signup       int64 `json:"signup"`
+	Signin       int64 `json:"signin"`
+	PostOrders   int64 `json:"post_orders"`
+	GetOrders    int64 `json:"get_orders"`
+	DeleteOrders int64 `json:"delete_orders"`
+	TradeSuccess int64 `json:"trade_success"`
+	GetInfo      int64 `json:"get_info"`
+	GetTop       int64 `json:"get_top"`
+
+	SignupPersist int64 `json:"signup_persist"`
+}
+
+func DefaultScoreConfig() *ScoreConfig {
+	return &ScoreConfig{
+		Signup:       SignupScore,
+		Signin:       SigninScore,
+		PostOrders:   PostOrdersScore,
+		GetOrders:    GetOrdersScore,
+		DeleteOrders: DeleteOrdersScore,
+		TradeSuccess: TradeSuccessScore,
+		GetInfo:      GetInfoScore,
+		GetTop:       GetTopScore,
+
+		SignupPersist: SignupPersistScore,
+	}
+}
+
+// LoadScoreConfig は JSON ファイルから ScoreConfig を読み込みます
+// ファイルに無い項目は const.go の値のままです
+func LoadScoreConfig(path string) (*ScoreConfig, error) {
+	sc := DefaultScoreConfig()
+	if path == "" {
+		return sc, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open score config failed")
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(sc); err != nil {
+		return nil, errors.Wrap(err, "parse score config failed")
+	}
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (sc *ScoreConfig) Validate() error {
+	for _, st := range []ScoreType{
+		ScoreTypeGetTop, ScoreTypeSignup, ScoreTypeSignin, ScoreTypeGetInfo,
+		ScoreTypePostOrders, ScoreTypeGetOrders, ScoreTypeDeleteOrders, ScoreTypeTradeSuccess,
+		ScoreTypeSignupPersist,
+	} {
+		if sc.Score(st) < 0 {
+			return errors.Errorf("score of %s must be non-negative", st)
+		}
+	}
+	return nil
+}
+
+func (sc *ScoreConfig) Score(st ScoreType) int64 {
 	switch st {
 	case ScoreTypeGetTop:
-		return GetTopScore
+		return sc.GetTop
 	case ScoreTypeSignup:
-		return SignupScore
+		return sc.Signup
 	case ScoreTypeSignin:
-		return SigninScore
+		return sc.Signin
 	case ScoreTypeGetInfo:
-		return GetInfoScore
+		return sc.GetInfo
 	case ScoreTypeGetOrders:
-		return GetOrdersScore
+		return sc.GetOrders
 	case ScoreTypePostOrders:
-		return PostOrdersScore
+		return sc.PostOrders
 	case ScoreTypeDeleteOrders:
-		return DeleteOrdersScore
+		return sc.DeleteOrders
 	case ScoreTypeTradeSuccess:
-		return TradeSuccessScore
+		return sc.TradeSuccess
+	case ScoreTypeSignupPersist:
+		return sc.SignupPersist
 	default:
 		log.Printf("[WARN] not defined score [%d]", st)
 		return 0
@@ -67,8 +139,9 @@ func (st ScoreType) Score() int64 {
 }
 
 type ScoreBoard struct {
-	count map[ScoreType]int64
-	mux   sync.Mutex
+	count  map[ScoreType]int64
+	config *ScoreConfig
+	mux    sync.Mutex
 }
 
 func (sb *ScoreBoard) Add(p ScoreType) {
@@ -86,13 +159,26 @@ func (sb *ScoreBoard) Dump() {
 	for i := 0; i < 15; i++ {
 		st := ScoreType(i)
 		if count, ok := sb.count[st]; ok {
-			log.Printf("[INFO] %-16s: score=%d, count=%d", st, count*st.Score(), count)
+			log.Printf("[INFO] %-16s: score=%d, count=%d", st, count*sb.config.Score(st), count)
 		}
 	}
 }
 
+// Counts は成功した操作ごとの件数を返します
+func (sb *ScoreBoard) Counts() map[string]int64 {
+	sb.mux.Lock()
+	defer sb.mux.Unlock()
+	r := make(map[string]int64, len(sb.count))
+	for st, count := range sb.count {
+		r[st.String()] = count
+	}
+	return r
+}
+
 type ScoreMsg struct {
 	st  ScoreType
 	err error
 	sns bool
+
+	signup bool // -weights の signup で新しいユーザーを追加する
 }
@@ -0,0 +1,68 @@
+package bench
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// signupCheckScenario は signup したユーザーで別の接続から signin できるかを確かめます
+// signup に成功してもユーザーをメモリにしか持たない実装を見つけるためです
+type signupCheckScenario struct {
+	*baseScenario
+	signin *Client
+}
+
+// NewSignupCheckScenario は signup で登録して、同じ bank_id と password の signin で確認します
+// signin は signup と transport の違う Client なので別の接続になります
+func NewSignupCheckScenario(signup, signin *Client, rnd *rand.Rand) Scenario {
+	return &signupCheckScenario{
+		baseScenario: &baseScenario{c: signup, rnd: rnd},
+		signin:       signin,
+	}
+}
+
+func (s *signupCheckScenario) Start(ctx context.Context, smchan chan ScoreMsg) error {
+	err := s.c.Signup(ctx)
+	smchan <- ScoreMsg{st: ScoreTypeSignup, err: err}
+	if err != nil {
+		return errors.Wrap(err, "アカウントを作成できませんでした")
+	}
+	err = s.signin.Signin(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "作成したアカウントで別の接続からログインできません。signup が永続化されていない可能性があります")
+	}
+	smchan <- ScoreMsg{st: ScoreTypeSignupPersist, err: err}
+	return err
+}
+
+// runSignupCheck は SignupCheckInterval ごとに新しい bank_id で signupCheckScenario を実行します
+func (c *Manager) runSignupCheck(ctx context.Context, smchan chan ScoreMsg) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-time.After(SignupCheckInterval):
+			target := c.nextTarget()
+			id, name, pass := c.FetchNewID(), c.rand.Name(), c.rand.Password()
+			signup, err := NewClient(target, id, name, pass, clientTimeout, RetireTimeout)
+			if err != nil {
+				log.Printf("[WARN] new client failed. err: %s", err)
+				continue
+			}
+			signin, err := NewClient(target, id, name, pass, clientTimeout, RetireTimeout)
+			if err != nil {
+				log.Printf("[WARN] new client failed. err: %s", err)
+				continue
+			}
+			if err := NewSignupCheckScenario(signup, signin, c.rng).Start(ctx, smchan); err != nil {
+				log.Printf("[INFO] signup check bankid:%s failed. %s", id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package bench
+
+import (
+	"sync"
+	"time"
+)
+
+// SoakWindow は -soak で得点を区切る時間幅です
+const SoakWindow = time.Minute
+
+// scoreWindows は得点を負荷走行開始からの時間で window ごとに集計します
+// nil の場合は何もしません
+type scoreWindows struct {
+	mu     sync.Mutex
+	size   time.Duration
+	start  time.Time
+	scores []int64
+}
+
+func newScoreWindows(size time.Duration) *scoreWindows {
+	return &scoreWindows{
+		size:   size,
+		scores: make([]int64, 0, 60),
+	}
+}
+
+func (w *scoreWindows) begin(t time.Time) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.start = t
+	w.scores = w.scores[:0]
+}
+
+func (w *scoreWindows) add(t time.Time, score int64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.start.IsZero() || t.Before(w.start) {
+		return
+	}
+	i := int(t.Sub(w.start) / w.size)
+	for len(w.scores) <= i {
+		w.scores = append(w.scores, 0)
+	}
+	w.scores[i] += score
+}
+
+// complete は end までに終わった window の得点を返します
+// 最後の途中までの window は比較にならないので含めません
+func (w *scoreWindows) complete(end time.Time) []int64 {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := int(end.Sub(w.start) / w.size)
+	if n > len(w.scores) {
+		n = len(w.scores)
+	}
+	r := make([]int64, n)
+	copy(r, w.scores[:n])
+	return r
+}
+
+// SoakResult は -soak での window ごとの得点と劣化の判定です
+type SoakResult struct {
+	Window    float64 `json:"window"` // 1 window の秒数
+	Scores    []int64 `json:"scores"`
+	Peak      int     `json:"peak"`      // 最も得点の高かった window の index
+	Regressed []int   `json:"regressed"` // peak より後で peak * threshold を下回った window の index
+}
+
+func newSoakResult(size time.Duration, scores []int64, threshold float64) *SoakResult {
+	r := &SoakResult{
+		Window:    size.Seconds(),
+		Scores:    scores,
+		Regressed: []int{},
+	}
+	for i, s := range scores {
+		if s > scores[r.Peak] {
+			r.Peak = i
+		}
+	}
+	if len(scores) == 0 {
+		return r
+	}
+	limit := float64(scores[r.Peak]) * threshold
+	for i := r.Peak + 1; i < len(scores); i++ {
+		if float64(scores[i]) < limit {
+			r.Regressed = append(r.Regressed, i)
+		}
+	}
+	return r
+}
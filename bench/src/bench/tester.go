@@ -14,6 +14,7 @@ import (
 )
 
 type PreTester struct {
+	rnd     *rand.Rand
 	appep   string
 	isulog  *isulog.Isulog
 	isubank *isubank.Isubank
@@ -27,11 +28,11 @@ func (t *PreTester) Run(ctx context.Context) error {
 	account2 := fmt.Sprintf("tmorris%d@isucon.net", now.Unix())
 	name1, name2 := "鈴木 明", "トニー モリス"
 
-	c1, err := NewClient(t.appep, account1, name1, "1234567890abc", ClientTimeout, RetireTimeout)
+	c1, err := NewClient(t.appep, account1, name1, "1234567890abc", clientTimeout, RetireTimeout)
 	if err != nil {
 		return errors.Wrap(err, "create new client failed")
 	}
-	c2, err := NewClient(t.appep, account2, name2, "234567890abcd", ClientTimeout, RetireTimeout)
+	c2, err := NewClient(t.appep, account2, name2, "234567890abcd", clientTimeout, RetireTimeout)
 	if err != nil {
 		return errors.Wrap(err, "create new client failed")
 	}
@@ -86,8 +87,8 @@ func (t *PreTester) Run(ctx context.Context) error {
 	})
 	eg.Go(func() error {
 		log.Printf("[INFO] run exists user test")
-		gd := testUsers[rand.Intn(10)]
-		gc, err := NewClient(t.appep, gd.BankID, gd.Name, gd.Pass, ClientTimeout, RetireTimeout)
+		gd := testUsers[t.rnd.Intn(10)]
+		gc, err := NewClient(t.appep, gd.BankID, gd.Name, gd.Pass, clientTimeout, RetireTimeout)
 		if err != nil {
 			return errors.Wrap(err, "create new client failed")
 		}
@@ -142,7 +143,7 @@ func (t *PreTester) Run(ctx context.Context) error {
 	}
 
 	for _, id := range []string{account1, account2} {
-		if err := t.isubank.NewBankID(id); err != nil {
+		if err := t.isubank.Register(id); err != nil {
 			return errors.Wrap(err, "new bank_id failed")
 		}
 	}
@@ -178,7 +179,7 @@ func (t *PreTester) Run(ctx context.Context) error {
 
 	{
 		log.Printf("[INFO] run conflict test")
-		c1x, err := NewClient(t.appep, account1, "鈴木 昭夫", "13467890abc", ClientTimeout, RetireTimeout)
+		c1x, err := NewClient(t.appep, account1, "鈴木 昭夫", "13467890abc", clientTimeout, RetireTimeout)
 		if err != nil {
 			return errors.Wrap(err, "create new client failed")
 		}
@@ -305,7 +306,7 @@ func (t *PreTester) Run(ctx context.Context) error {
 						if len(info.TradedOrders) >= 1 {
 							return nil
 						}
-						time.Sleep(PollingInterval)
+						time.Sleep(pollingInterval)
 					}
 				}
 			}()
@@ -386,7 +387,7 @@ func (t *PreTester) Run(ctx context.Context) error {
 							log.Printf("[INFO] ログチェック OK(c1)")
 							return nil
 						}
-						time.Sleep(PollingInterval)
+						time.Sleep(pollingInterval)
 					}
 				}
 			}()
@@ -407,7 +408,7 @@ func (t *PreTester) Run(ctx context.Context) error {
 						if len(info.TradedOrders) == 2 {
 							return nil
 						}
-						time.Sleep(PollingInterval)
+						time.Sleep(pollingInterval)
 					}
 				}
 			}()
@@ -487,7 +488,7 @@ func (t *PreTester) Run(ctx context.Context) error {
 							log.Printf("[INFO] ログチェック OK(c2)")
 							return nil
 						}
-						time.Sleep(PollingInterval)
+						time.Sleep(pollingInterval)
 					}
 				}
 			}()
@@ -512,6 +513,7 @@ type testUser interface {
 }
 
 type PostTester struct {
+	rnd     *rand.Rand
 	appep   string
 	isulog  *isulog.Isulog
 	isubank *isubank.Isubank
@@ -531,9 +533,9 @@ func (t *PostTester) Run(ctx context.Context) error {
 	}
 	var trade *Trade
 	{
-		first, latest, random := users[0], users[len(users)-1], users[rand.Intn(len(users))]
+		first, latest, random := users[0], users[len(users)-1], users[t.rnd.Intn(len(users))]
 		for len(users) >= 3 && (first.UserID() == random.UserID() || latest.UserID() == random.UserID()) {
-			random = users[rand.Intn(len(users)-2)+1]
+			random = users[t.rnd.Intn(len(users)-2)+1]
 		}
 		for _, user := range users {
 			for _, order := range user.Orders() {
@@ -617,7 +619,7 @@ func (t *PostTester) Run(ctx context.Context) error {
 					return nil
 				}
 			}
-			time.Sleep(PollingInterval)
+			time.Sleep(pollingInterval)
 		}
 	})
 	for _, tu := range t.tested {
@@ -722,7 +724,7 @@ func (t *PostTester) Run(ctx context.Context) error {
 						return nil
 					}
 				}
-				time.Sleep(PollingInterval)
+				time.Sleep(pollingInterval)
 			}
 		})
 	}
@@ -0,0 +1,160 @@
+package bench
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tracer は -trace-sample の割合のリクエストについて、接続のどこで時間がかかったかを JSON lines で書き出します
+// nil の場合は何もしません
+var tracer *requestTracer
+
+type requestTracer struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	f    *os.File
+	rate float64
+	rnd  *rand.Rand
+}
+
+// EnableTrace は rate の割合のリクエストの httptrace を path に書き出すようにします
+// 乱数はシナリオに影響しないように別に持ちます
+func EnableTrace(path string, rate float64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create trace file failed")
+	}
+	tracer = &requestTracer{
+		enc:  json.NewEncoder(f),
+		f:    f,
+		rate: rate,
+		rnd:  rand.New(newLockedSource(seed)),
+	}
+	return nil
+}
+
+// CloseTrace は trace の書き出しを終わります
+func CloseTrace() error {
+	if tracer == nil {
+		return nil
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	return tracer.f.Close()
+}
+
+// requestTrace は1回のリクエストの時間の内訳です。時間はすべてミリ秒です
+// Client と Body は -replay で同じリクエストを送り直すために、BodyMD5 はレスポンスを比べるために記録します
+type requestTrace struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client,omitempty"`
+	Method  string    `json:"method"`
+	URL     string    `json:"url"`
+	Body    string    `json:"body,omitempty"`
+	Status  int       `json:"status"`
+	BodyMD5 string    `json:"body_md5,omitempty"`
+	Reused  bool      `json:"reused"`
+	DNS     float64   `json:"dns_ms"`
+	Connect float64   `json:"connect_ms"`
+	TLS     float64   `json:"tls_ms"`
+	TTFB    float64   `json:"ttfb_ms"`
+	Total   float64   `json:"total_ms"`
+	Error   string    `json:"error,omitempty"`
+
+	// httptrace の callback は transport の dial の goroutine からも呼ばれるので mu で守ります
+	mu                                      sync.Mutex
+	start, dnsStart, connectStart, tlsStart time.Time
+}
+
+func (rt *requestTrace) update(f func()) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	f()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// sample は trace する場合に httptrace を仕込んだ req と記録先を返します
+// client はリクエストしたユーザーの bank_id です
+func (t *requestTracer) sample(req *http.Request, body []byte, client string) (*http.Request, *requestTrace) {
+	if t == nil {
+		return req, nil
+	}
+	if t.rnd.Float64() >= t.rate {
+		return req, nil
+	}
+	rt := &requestTrace{
+		Time:   time.Now(),
+		Client: client,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Body:   string(body),
+		start:  time.Now(),
+	}
+	ct := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			rt.update(func() { rt.start = time.Now() })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.update(func() { rt.Reused = info.Reused })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rt.update(func() { rt.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			rt.update(func() { rt.DNS = ms(time.Since(rt.dnsStart)) })
+		},
+		ConnectStart: func(string, string) {
+			rt.update(func() { rt.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			rt.update(func() { rt.Connect = ms(time.Since(rt.connectStart)) })
+		},
+		TLSHandshakeStart: func() {
+			rt.update(func() { rt.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rt.update(func() { rt.TLS = ms(time.Since(rt.tlsStart)) })
+		},
+		GotFirstResponseByte: func() {
+			rt.update(func() { rt.TTFB = ms(time.Since(rt.start)) })
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), ct)), rt
+}
+
+// finish は res が nil でなければ status と body の hash を記録します。body は読んだ後に戻します
+func (t *requestTracer) finish(rt *requestTrace, res *http.Response, err error) {
+	if rt == nil {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.Total = ms(time.Since(rt.start))
+	if res != nil {
+		rt.Status = res.StatusCode
+		rt.BodyMD5 = bodyMD5(peekBody(res))
+	}
+	if err != nil {
+		rt.Error = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(rt)
+}
+
+func bodyMD5(b []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(b))
+}
@@ -0,0 +1,108 @@
+package bench
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ErrTradeInconsistent はポーリングの間で取引の内容が矛盾していることを表します
+// レイテンシの問題ではなく app の正しさの問題なので ErrorTypeTradeInconsistency に分類します
+type ErrTradeInconsistent struct {
+	UserID int64
+	Path   string
+	Msg    string
+}
+
+func (e *ErrTradeInconsistent) Error() string {
+	return fmt.Sprintf("%s 取引の内容が前回と矛盾しています [user_id:%d]: %s", e.Path, e.UserID, e.Msg)
+}
+
+// tradeView はユーザーごとにこれまでに見た取引を覚えておき、次のレスポンスと矛盾がないかを調べます
+// - 一度成立した注文は消えず、trade_id も変わらない
+// - 注文の並び順は変わらない
+// - 同じ trade_id の amount と price は変わらない
+type tradeView struct {
+	mu         sync.Mutex
+	trades     map[int64]Trade
+	orderTrade map[int64]int64
+	orderIDs   []int64
+}
+
+func newTradeView() *tradeView {
+	return &tradeView{
+		trades:     make(map[int64]Trade, 20),
+		orderTrade: make(map[int64]int64, 20),
+	}
+}
+
+// checkOrders は GET /orders のレスポンスを前回までのものと比べて覚えます
+func (v *tradeView) checkOrders(userID int64, path string, orders []Order) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	pos := make(map[int64]int, len(orders))
+	for i, o := range orders {
+		pos[o.ID] = i
+	}
+	for oid, tid := range v.orderTrade {
+		i, ok := pos[oid]
+		if !ok {
+			return &ErrTradeInconsistent{userID, path, fmt.Sprintf("成立した注文が消えました order_id:%d, trade_id:%d", oid, tid)}
+		}
+		if t := orders[i].Trade; t == nil || t.ID != tid {
+			return &ErrTradeInconsistent{userID, path, fmt.Sprintf("成立した注文の取引が変わりました order_id:%d, trade_id:%d", oid, tid)}
+		}
+	}
+	last := -1
+	for _, oid := range v.orderIDs {
+		i, ok := pos[oid]
+		if !ok {
+			// 取り消された注文は消えることがある
+			continue
+		}
+		if i < last {
+			return &ErrTradeInconsistent{userID, path, fmt.Sprintf("注文の並び順が変わりました order_id:%d", oid)}
+		}
+		last = i
+	}
+	for _, o := range orders {
+		if o.Trade == nil {
+			continue
+		}
+		if err := v.observe(userID, path, o.Trade); err != nil {
+			return err
+		}
+		v.orderTrade[o.ID] = o.Trade.ID
+	}
+	v.orderIDs = v.orderIDs[:0]
+	for _, o := range orders {
+		v.orderIDs = append(v.orderIDs, o.ID)
+	}
+	return nil
+}
+
+// checkTraded は GET /info の traded_orders の取引を前回までのものと比べて覚えます
+func (v *tradeView) checkTraded(userID int64, path string, orders []Order) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, o := range orders {
+		if o.Trade == nil {
+			continue
+		}
+		if err := v.observe(userID, path, o.Trade); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *tradeView) observe(userID int64, path string, t *Trade) error {
+	if prev, ok := v.trades[t.ID]; ok {
+		if prev.Amount != t.Amount || prev.Price != t.Price {
+			return &ErrTradeInconsistent{userID, path, fmt.Sprintf("trade_id:%d の内容が変わりました amount:%d->%d, price:%d->%d", t.ID, prev.Amount, t.Amount, prev.Price, t.Price)}
+		}
+		return nil
+	}
+	v.trades[t.ID] = *t
+	return nil
+}
@@ -0,0 +1,76 @@
+package bench
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ValidateResult は -validate で実行したシナリオごとの結果です
+type ValidateResult struct {
+	Scenario string
+	Err      error
+}
+
+// ValidateScenarios は負荷をかけずに各シナリオを1回ずつ順番に実行して検証します
+// スコアは加算しません
+func (c *Manager) ValidateScenarios(ctx context.Context) []ValidateResult {
+	results := make([]ValidateResult, 0, 3)
+	run := func(name string, f func(smchan chan ScoreMsg) error) {
+		smchan := make(chan ScoreMsg, 100)
+		err := f(smchan)
+		close(smchan)
+		for s := range smchan {
+			if err == nil && s.err != nil {
+				err = s.err
+			}
+		}
+		results = append(results, ValidateResult{Scenario: name, Err: err})
+	}
+
+	run("normal", func(smchan chan ScoreMsg) error {
+		var credit, isu, unit int64 = 30000, 5, 1
+		cl, err := NewClient(c.nextTarget(), c.FetchNewID(), c.rand.Name(), c.rand.Password(), clientTimeout, RetireTimeout)
+		if err != nil {
+			return err
+		}
+		if err := c.isubank.AddCredit(cl.bankid, credit); err != nil {
+			return errors.Wrap(err, "isubank add credit failed")
+		}
+		return newNormalScenario(cl, credit, isu, unit, false, c.rng).runOnce(ctx, smchan)
+	})
+
+	if tu := c.nextTestUser(6); tu.BankID != "" {
+		run("exists_user", func(smchan chan ScoreMsg) error {
+			cl, err := NewClient(c.nextTarget(), tu.BankID, tu.Name, tu.Pass, clientTimeout, RetireTimeout)
+			if err != nil {
+				return err
+			}
+			credit, err := c.isubank.GetCredit(tu.BankID)
+			if err != nil {
+				return err
+			}
+			s := newNormalScenario(cl, credit, 10, 3, false, c.rng)
+			s.existed = true
+			return s.runOnce(ctx, smchan)
+		})
+	}
+
+	if tu := c.nextTestUser(10); tu.BankID != "" {
+		run("brute_force", func(smchan chan ScoreMsg) error {
+			cl, err := NewClient(c.nextTarget(), tu.BankID, tu.Name, "12345", clientTimeout, RetireTimeout)
+			if err != nil {
+				return err
+			}
+			err = cl.Signin(ctx)
+			if err == nil {
+				return errors.Errorf("不正ログインに成功しました")
+			}
+			if e, ok := err.(*ErrorWithStatus); ok && (e.StatusCode == 403 || e.StatusCode == 404) {
+				return nil
+			}
+			return err
+		})
+	}
+	return results
+}
@@ -0,0 +1,138 @@
+package bench
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Action は負荷走行中の各ユーザーが1回の行動で行う操作です
+type Action string
+
+const (
+	ActionOrder  Action = "order"  // 注文の作成/取消 (従来の行動)
+	ActionTrades Action = "trades" // GET /info で取引状況を取得
+	ActionOrders Action = "orders" // GET /orders で注文履歴を取得
+	ActionSignup Action = "signup" // 新しいユーザーを追加
+)
+
+var actions = []Action{ActionOrder, ActionTrades, ActionOrders, ActionSignup}
+
+// actionWeights は -weights の時に各ユーザーの次の行動を重み付きで選びます
+// nil の場合は従来通り常に注文を行います
+var actionWeights *weightPicker
+
+type weightPicker struct {
+	actions []Action
+	cum     []int
+	total   int
+	counts  []int64
+}
+
+// ParseWeights は "order=70,trades=20,signup=10" の形式の重みを読み込みます
+// 重みは相対値で、合計が100である必要はありません
+func ParseWeights(s string) (map[Action]int, error) {
+	w := make(map[Action]int, len(actions))
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid weight %q: expected action=weight", kv)
+		}
+		a := Action(strings.TrimSpace(kv[:i]))
+		if !a.valid() {
+			return nil, fmt.Errorf("unknown action %q: must be one of %v", a, actions)
+		}
+		if _, ok := w[a]; ok {
+			return nil, fmt.Errorf("duplicate action %q", a)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight of %s: %s", a, err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("weight of %s must not be negative", a)
+		}
+		w[a] = n
+	}
+	if w[ActionOrder] == 0 && w[ActionSignup] == 0 {
+		// 注文もユーザーの追加もしないと取引が発生しないので負荷走行になりません
+		return nil, fmt.Errorf("weights must include order or signup")
+	}
+	return w, nil
+}
+
+func (a Action) valid() bool {
+	for _, b := range actions {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableWeights は各ユーザーの行動を weights の比率で選ぶようにします
+func EnableWeights(weights map[Action]int) {
+	p := &weightPicker{}
+	for _, a := range actions {
+		if weights[a] <= 0 {
+			continue
+		}
+		p.total += weights[a]
+		p.actions = append(p.actions, a)
+		p.cum = append(p.cum, p.total)
+	}
+	p.counts = make([]int64, len(p.actions))
+	actionWeights = p
+}
+
+func (p *weightPicker) pick(rnd *rand.Rand) Action {
+	if p == nil {
+		return ActionOrder
+	}
+	n := rnd.Intn(p.total)
+	i := sort.SearchInts(p.cum, n+1)
+	atomic.AddInt64(&p.counts[i], 1)
+	return p.actions[i]
+}
+
+// ActionCounts は実際に選ばれた行動ごとの回数を返します
+func (p *weightPicker) ActionCounts() map[string]int64 {
+	if p == nil {
+		return nil
+	}
+	r := make(map[string]int64, len(p.actions))
+	for i, a := range p.actions {
+		r[string(a)] = atomic.LoadInt64(&p.counts[i])
+	}
+	return r
+}
+
+// Dump は指定した比率と実際に選ばれた比率をログに出します
+func (p *weightPicker) Dump() {
+	if p == nil {
+		return
+	}
+	var sum int64
+	for i := range p.counts {
+		sum += atomic.LoadInt64(&p.counts[i])
+	}
+	prev := 0
+	for i, a := range p.actions {
+		n := atomic.LoadInt64(&p.counts[i])
+		var realized float64
+		if sum > 0 {
+			realized = float64(n) * 100 / float64(sum)
+		}
+		expected := float64(p.cum[i]-prev) * 100 / float64(p.total)
+		prev = p.cum[i]
+		log.Printf("[INFO] action %-8s: count=%d, realized=%.1f%%, expected=%.1f%%", a, n, realized, expected)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// auditLogger は -audit-log に credit の変更を1行1JSONで追記します
+// nil の場合はすべて何もしません
+type auditLogger struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+type auditEntry struct {
+	Time    string `json:"time"`
+	UserID  int64  `json:"user_id"`
+	Amount  int64  `json:"amount"`
+	Balance int64  `json:"balance"`
+	Note    string `json:"note"`
+	ReqID   string `json:"req_id"`
+}
+
+// auditBuffer は transaction 中の変更を commit されるまで溜めておきます
+type auditBuffer struct {
+	entries []auditEntry
+}
+
+func newAuditLogger(path string) (*auditLogger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open audit log failed")
+	}
+	return &auditLogger{f: f}, nil
+}
+
+// Close は -audit-log のファイルを閉じます。shutdown で処理中の transaction が終わった後に呼びます
+func (a *auditLogger) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// begin は transaction 用の buffer を ctx に持たせます
+func (a *auditLogger) begin(ctx context.Context) context.Context {
+	if a == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, AuditCtxKey, &auditBuffer{})
+}
+
+// record は ctx の buffer に変更を追加します。書き出されるのは commit 後です
+func (a *auditLogger) record(ctx context.Context, userID, amount, balance int64, note string) {
+	if a == nil {
+		return
+	}
+	buf, ok := ctx.Value(AuditCtxKey).(*auditBuffer)
+	if !ok {
+		return
+	}
+	reqID, _ := ctx.Value(RequestIDCtxKey).(string)
+	buf.entries = append(buf.entries, auditEntry{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		UserID:  userID,
+		Amount:  amount,
+		Balance: balance,
+		Note:    note,
+		ReqID:   reqID,
+	})
+}
+
+// flush は commit された transaction の変更を書き出します
+func (a *auditLogger) flush(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	buf, ok := ctx.Value(AuditCtxKey).(*auditBuffer)
+	if !ok || len(buf.entries) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	enc := json.NewEncoder(a.f)
+	for _, e := range buf.entries {
+		if err := enc.Encode(e); err != nil {
+			return errors.Wrap(err, "write audit log failed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// faultInjector は -fail-rate の割合で 500 を返すか、-fail-delay だけ待たせてから 500 を返します
+// ベンチマークが不安定な銀行をちゃんと減点できるかを確かめるためのものです
+// -fail-seed が同じなら同じ順番のリクエストが失敗します
+// -fail-rate が指定されていない場合は nil で、その場合は何もしません
+type faultInjector struct {
+	mu    sync.Mutex
+	rnd   *rand.Rand
+	rate  float64
+	delay time.Duration
+}
+
+func newFaultInjector(rate float64, seed int64, delay time.Duration) *faultInjector {
+	return &faultInjector{
+		rnd:   rand.New(rand.NewSource(seed)),
+		rate:  rate,
+		delay: delay,
+	}
+}
+
+// roll は失敗させる場合に true と、待たせるかどうかを返します
+func (fi *faultInjector) roll() (bool, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.rnd.Float64() >= fi.rate {
+		return false, false
+	}
+	return true, fi.rnd.Intn(2) == 0
+}
+
+func (fi *faultInjector) inject(endpoint string, f http.HandlerFunc) http.HandlerFunc {
+	if fi == nil {
+		return f
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fail, slow := fi.roll()
+		if !fail {
+			f.ServeHTTP(w, r)
+			return
+		}
+		if slow {
+			logf(r, "info", "injected failure. endpoint: %s, delay: %s, req_id: %s", endpoint, fi.delay, requestID(r))
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(fi.delay):
+			}
+		} else {
+			logf(r, "info", "injected failure. endpoint: %s, req_id: %s", endpoint, requestID(r))
+		}
+		Error(w, "internal server error (injected)", http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// Clock は予約の期限判定に使う現在時刻です
+// テストでは偽物を差し込んで reserveTTL を過ぎた状態を作ります
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
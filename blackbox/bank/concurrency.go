@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyLimiter は endpoint ごとに同時に実行する transaction の数を制限する semaphore です
+// 上限が 0 の場合は nil で、その場合は制限しません
+type concurrencyLimiter struct {
+	sem      chan struct{}
+	wait     time.Duration
+	inflight int64
+}
+
+func newConcurrencyLimiter(max int, wait time.Duration) *concurrencyLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &concurrencyLimiter{
+		sem:  make(chan struct{}, max),
+		wait: wait,
+	}
+}
+
+// acquire は空きを wait の間だけ待ちます。取得できなければ false を返します
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(l.wait)
+	defer t.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// limit は同時実行数が上限に達していたら少し待ち、それでも空かなければ 429 を返します
+func (l *concurrencyLimiter) limit(f http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return f
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			logf(r, "info", "concurrency limit reached. path: %s", r.URL.Path)
+			ErrorWithCode(w, "too many concurrent requests", "too_many_concurrent_requests", http.StatusTooManyRequests)
+			return
+		}
+		atomic.AddInt64(&l.inflight, 1)
+		defer func() {
+			atomic.AddInt64(&l.inflight, -1)
+			<-l.sem
+		}()
+		f.ServeHTTP(w, r)
+	})
+}
+
+// Inflight は実行中のリクエスト数です
+func (l *concurrencyLimiter) Inflight() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.inflight)
+}
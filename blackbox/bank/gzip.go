@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GzipMinSize はこれより小さいレスポンスは圧縮しない byte 数です。小さいものは圧縮しても得にならないためです
+const GzipMinSize = 1024
+
+// gzipHandler は Accept-Encoding に gzip を含むリクエストのレスポンスを圧縮します
+// 圧縮するかをレスポンスの大きさで決めるために一度すべて buffer に書いてから返すので、一覧のような大きさに上限がある endpoint に使います
+func gzipHandler(min int, f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) {
+			f.ServeHTTP(w, r)
+			return
+		}
+		bw := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+		f.ServeHTTP(bw, r)
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if bw.body.Len() < min || w.Header().Get("Content-Encoding") != "" {
+			w.WriteHeader(bw.status)
+			w.Write(bw.body.Bytes())
+			return
+		}
+		b := &bytes.Buffer{}
+		gw := gzip.NewWriter(b)
+		gw.Write(bw.body.Bytes())
+		gw.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+		w.WriteHeader(bw.status)
+		w.Write(b.Bytes())
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(e, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter は status と body を書き出さずに覚えておきます
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
@@ -0,0 +1,145 @@
+// +build integration
+
+package main_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	main "github.com/ken39arg/isucon2018-final/blackbox/bank"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// go test -tags integration で MySQL のコンテナを起動し、ISUBANK_TEST_DSN を設定してからテストを実行します
+// DB を使うテスト(TestCreditConsistency, TestReserveExpiry など)もこのコンテナで実行されます
+func TestMain(m *testing.M) {
+	os.Exit(runWithMySQL(m))
+}
+
+func runWithMySQL(m *testing.M) int {
+	if os.Getenv("ISUBANK_TEST_DSN") != "" {
+		return m.Run()
+	}
+	ctx := context.Background()
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "mysql:8",
+			ExposedPorts: []string{"3306/tcp"},
+			Env: map[string]string{
+				"TZ":                  "Asia/Tokyo",
+				"MYSQL_ROOT_PASSWORD": "root",
+			},
+			WaitingFor: wait.ForListeningPort("3306/tcp"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		log.Printf("start mysql container failed. err: %s", err)
+		return 1
+	}
+	defer c.Terminate(ctx)
+
+	host, err := c.Host(ctx)
+	if err != nil {
+		log.Printf("get container host failed. err: %s", err)
+		return 1
+	}
+	port, err := c.MappedPort(ctx, "3306/tcp")
+	if err != nil {
+		log.Printf("get mapped port failed. err: %s", err)
+		return 1
+	}
+	if err := applySchema(fmt.Sprintf("root:root@tcp(%s:%s)/?multiStatements=true", host, port.Port())); err != nil {
+		log.Printf("apply schema failed. err: %s", err)
+		return 1
+	}
+	os.Setenv("ISUBANK_TEST_DSN", fmt.Sprintf("root:root@tcp(%s:%s)/isubank?parseTime=true&loc=Local&charset=utf8mb4", host, port.Port()))
+	return m.Run()
+}
+
+// applySchema は ../sql のスキーマを流します。データ(z_isubankdata.sql.gz)は入れません
+func applySchema(dsn string) error {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// port が開いてもしばらくは接続できないことがあるので待つ
+	for i := 0; ; i++ {
+		if err = db.Ping(); err == nil {
+			break
+		}
+		if i >= 30 {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+	for _, f := range []string{"../sql/00_create_bank_database.sql", "../sql/isubank.sql"} {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(string(b)); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+	}
+	return nil
+}
+
+func TestRegisterToCommit(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "e2e", 1000)
+
+	// 残高不足
+	code, b := postJSON(t, s.URL, "/reserve", "AAA", map[string]interface{}{"bank_id": bankID, "price": -1001})
+	if code != 400 {
+		t.Errorf("unexpected status of insufficient reserve: got:%d expected:400 body:%s", code, b)
+	}
+	var eres struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(b, &eres)
+	if eres.Code != "insufficient_credit" {
+		t.Errorf("unexpected code of insufficient reserve: got:%s expected:insufficient_credit", eres.Code)
+	}
+
+	rid := reserve(t, s.URL, bankID, -600)
+
+	// 予約中の分は使えない
+	if code, b := postJSON(t, s.URL, "/reserve", "AAA", map[string]interface{}{"bank_id": bankID, "price": -600}); code != 400 {
+		t.Errorf("unexpected status of reserve over reserved: got:%d expected:400 body:%s", code, b)
+	}
+
+	if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}}); code != 200 {
+		t.Fatalf("commit failed: %d %s", code, b)
+	}
+	// 2回目の commit はできない
+	if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}}); code != 409 {
+		t.Errorf("unexpected status of second commit: got:%d expected:409 body:%s", code, b)
+	}
+	// idempotent なら再送は成功になる
+	if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}, "idempotent": true}); code != 200 {
+		t.Errorf("unexpected status of idempotent commit: got:%d expected:200 body:%s", code, b)
+	}
+
+	var credit int64
+	if err := db.QueryRow(`SELECT credit FROM user WHERE bank_id = ?`, bankID).Scan(&credit); err != nil {
+		t.Fatal(err)
+	}
+	if credit != 400 {
+		t.Errorf("unexpected credit: got:%d expected:400", credit)
+	}
+}
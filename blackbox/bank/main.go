@@ -1,20 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 
 	//	"encoding/json"
 	//	"flag"
 	//	"fmt"
 	//	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
@@ -22,28 +36,109 @@ import (
 )
 
 const (
-	ResOK        = `{}`
-	ResError     = `{"error":"%s"}`
 	LocationName = "Asia/Tokyo"
 	AxLog        = false
 	AppIDCtxKey  = "appid"
+
+	CreditHistoryDefaultLimit = 100
+	CreditHistoryMaxLimit     = 1000
+
+	RequestIDCtxKey = "reqid"
+	RequestIDHeader = "X-Request-ID"
+	SignatureHeader = "X-Signature"
+	AuditCtxKey     = "audit"
+
+	ServerTimingCtxKey = "server_timing"
 )
 
 var cacheBankID = make(map[string]int64, 1000)
 var cacheBankIDMutex sync.RWMutex
 
+var (
+	latency       = flag.Duration("latency", 0, "additional latency of check/reserve/commit/cancel")
+	latencyJitter = flag.Duration("latency-jitter", 0, "random jitter (+-) of additional latency")
+	logFormat     = flag.String("log-format", "text", "log format (text|json)")
+	enableMetrics = flag.Bool("enable-metrics", false, "enable prometheus /metrics endpoint")
+	reserveTTL    = flag.Duration("reserve-ttl", 5*time.Minute, "expiry window of reserve")
+	expiryGrace   = flag.Duration("expiry-grace", 0, "treat reserves as active for this long after expire_at to tolerate clock skew between servers")
+	maxPrice      = flag.Int64("max-price", 1e15, "max absolute value of price")
+	minorUnits    = flag.Int("minor-units", 0, "decimal places accepted in string prices, e.g. 2 reads \"12.34\" as 1234 (number prices are always minor units)")
+	enableReset   = flag.Bool("enable-reset", false, "enable /reset endpoint (never use in production)")
+	noteFormat    = flag.String("reserve-note-format", "", "text/template of reserve note with .AppID, .Price, .BankID and .Now (default \"app:{{.AppID}}, price:{{.Price}}\")")
+	enableGzip    = flag.Bool("enable-gzip", false, "gzip responses of /credit_history, /reserves and /reserve_status when the client accepts it")
+	enableExpire  = flag.Bool("enable-expire", false, "enable /expire endpoint to expire a reserve immediately (never use in production)")
+	rateLimit     = flag.Float64("rate-limit", 0, "requests/sec per app_id (0 is unlimited)")
+	rateBurst     = flag.Int("rate-burst", 10, "burst size of rate limit per app_id")
+	queryTimeout  = flag.Duration("query-timeout", 0, "timeout of each transaction (0 is unlimited)")
+	auditLog      = flag.String("audit-log", "", "append committed credit changes to this file as JSON lines")
+	hmacSecret    = flag.String("hmac-secret", "", "require X-Signature (hex HMAC-SHA256 of body) when set")
+	slowQuery     = flag.Duration("slow-query", 0, "log queries in transactions slower than this (0 is disabled)")
+	failRate      = flag.Float64("fail-rate", 0, "fraction of /reserve and /commit requests answered by injected 500 or delay (chaos testing)")
+	failSeed      = flag.Int64("fail-seed", 1, "random seed of -fail-rate")
+	failDelay     = flag.Duration("fail-delay", 10*time.Second, "delay before an injected slow failure")
+
+	statsTTL          = flag.Duration("stats-ttl", time.Second, "cache duration of /stats")
+	txRetry           = flag.Int("tx-retry", 3, "max retries of a transaction on deadlock, lock wait timeout or user.credit conflict")
+	txIsolation       = flag.String("tx-isolation", "", "isolation level of transactions (READ-UNCOMMITTED|READ-COMMITTED|REPEATABLE-READ|SERIALIZABLE, default server's)")
+	registerBulkMax   = flag.Int("register-bulk-max", 1000, "max number of bank_ids in a /register_bulk request")
+	maxBody           = flag.Int64("max-body", 1<<20, "max bytes of a request body")
+	maxReserveIDs     = flag.Int("max-reserve-ids", 1000, "max number of reserve_ids in a /commit or /cancel request")
+	warnBatchSize     = flag.Int("warn-batch-size", 100, "log a warning when a /commit or /cancel request has more reserve_ids than this (0 is disabled)")
+	maxReserves       = flag.Int("max-reserves-per-user", 0, "max number of active reserves of a user (0 is unlimited)")
+	maxCredit         = flag.Int64("max-credit", 0, "max credit of a user. add_credit and commit over this are rejected (0 is unlimited)")
+	idempotencyWindow = flag.Duration("idempotency-window", 24*time.Hour, "window in which add_credit idempotency_key is remembered")
+	serverTimeout     = flag.Duration("server-timeout", 0, "deadline of each request. transactions are canceled and 503 server_timeout is returned when exceeded (0 is unlimited)")
+
+	maxConcurrentCheck   = flag.Int("max-concurrent-check", 0, "max in-flight /check requests (0 is unlimited)")
+	maxConcurrentReserve = flag.Int("max-concurrent-reserve", 0, "max in-flight /reserve, /reserve_multi and /reserve_update requests (0 is unlimited)")
+	maxConcurrentCommit  = flag.Int("max-concurrent-commit", 0, "max in-flight /commit, /charge and /transfer requests (0 is unlimited)")
+	maxConcurrentCancel  = flag.Int("max-concurrent-cancel", 0, "max in-flight /cancel requests (0 is unlimited)")
+	concurrentWait       = flag.Duration("concurrent-wait", 100*time.Millisecond, "time to wait for a free slot of -max-concurrent-* before answering 429")
+)
+
 func main() {
 	var (
 		port   = flag.Int("port", 5515, "bank app running port")
+		socket = flag.String("socket", "", "listen on this unix domain socket instead of tcp port")
 		dbhost = flag.String("dbhost", "127.0.0.1", "database host")
 		dbport = flag.Int("dbport", 3306, "database port")
 		dbuser = flag.String("dbuser", "root", "database user")
 		dbpass = flag.String("dbpass", "", "database pass")
 		dbname = flag.String("dbname", "isubank", "database name")
+
+		tlsCert      = flag.String("tls-cert", "", "serve HTTPS with this certificate file (with -tls-key)")
+		tlsKey       = flag.String("tls-key", "", "serve HTTPS with this private key file (with -tls-cert)")
+		httpRedirect = flag.String("http-redirect", "", "listen address of plain HTTP redirecting to HTTPS, e.g. :80 (requires -tls-cert)")
+
+		dbReplicaDSN = flag.String("db-replica-dsn", "", "DSN of read replica for /credit, /balance, /check, /credit_history, /reserves and /stats (default primary)")
+
+		dbMaxOpen         = flag.Int("db-max-open", 50, "max open connections to the database (0 is unlimited)")
+		dbMaxIdle         = flag.Int("db-max-idle", 50, "max idle connections to the database")
+		dbConnMaxLifetime = flag.Duration("db-conn-max-lifetime", 5*time.Minute, "max lifetime of a database connection (0 is unlimited)")
+
+		shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "graceful shutdown timeout")
+		gcInterval      = flag.Duration("gc-interval", 30*time.Second, "interval of deleting expired reserves (0 is disabled)")
+		dbWait          = flag.Duration("db-wait", 30*time.Second, "max time to wait for the database to be ready at startup")
+		tz              = flag.String("tz", LocationName, "time zone of timestamps and database times, e.g. UTC")
 	)
 
 	flag.Parse()
 
+	if err := setLocation(*tz); err != nil {
+		log.Fatalf("invalid -tz. err: %s", err)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("-tls-cert and -tls-key must be specified together")
+	}
+	useTLS := *tlsCert != ""
+	if *httpRedirect != "" && !useTLS {
+		log.Fatalf("-http-redirect requires -tls-cert and -tls-key")
+	}
+	// int64 に収まる桁数までにする
+	if *minorUnits < 0 || *minorUnits > 18 {
+		log.Fatalf("-minor-units must be between 0 and 18")
+	}
+
 	addr := fmt.Sprintf(":%d", *port)
 	dbup := *dbuser
 	if *dbpass != "" {
@@ -55,41 +150,465 @@ func main() {
 	if err != nil {
 		log.Fatalf("mysql connect failed. err: %s", err)
 	}
-	server := NewServer(db)
+	db.SetMaxOpenConns(*dbMaxOpen)
+	db.SetMaxIdleConns(*dbMaxIdle)
+	db.SetConnMaxLifetime(*dbConnMaxLifetime)
+	if err := waitDB(db, *dbWait); err != nil {
+		log.Fatalf("mysql is not ready. err: %s", err)
+	}
+	var replica *sql.DB
+	if *dbReplicaDSN != "" {
+		// primary と同じく時刻を time.Time で読めるように parseTime と loc を揃える
+		cfg, err := mysql.ParseDSN(*dbReplicaDSN)
+		if err != nil {
+			log.Fatalf("invalid -db-replica-dsn. err: %s", err)
+		}
+		cfg.ParseTime = true
+		cfg.Loc = time.Local
+		replica, err = sql.Open("mysql", cfg.FormatDSN())
+		if err != nil {
+			log.Fatalf("mysql replica connect failed. err: %s", err)
+		}
+		replica.SetMaxOpenConns(*dbMaxOpen)
+		replica.SetMaxIdleConns(*dbMaxIdle)
+		replica.SetConnMaxLifetime(*dbConnMaxLifetime)
+		if err := waitDB(replica, *dbWait); err != nil {
+			log.Fatalf("mysql replica is not ready. err: %s", err)
+		}
+		log.Printf("[INFO] read replica enabled")
+	}
+	audit, err := newAuditLogger(*auditLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := newServer(db, replica, realClock{}, audit)
+	if *gcInterval > 0 {
+		go gcReserves(db, *gcInterval)
+	}
 
-	log.Printf("[INFO] start server %s", addr)
+	log.Printf("[INFO] additional latency %s (jitter +-%s)", *latency, *latencyJitter)
+	log.Printf("[INFO] reserve ttl %s", *reserveTTL)
+	log.Printf("[INFO] max price %d", *maxPrice)
+	if *hmacSecret != "" {
+		log.Printf("[INFO] hmac signature required")
+	}
+	if *rateLimit > 0 {
+		log.Printf("[INFO] rate limit %.2f req/s per app_id (burst %d)", *rateLimit, *rateBurst)
+	}
+	if *queryTimeout > 0 {
+		log.Printf("[INFO] query timeout %s", *queryTimeout)
+	}
+	if *serverTimeout > 0 {
+		log.Printf("[INFO] server timeout %s", *serverTimeout)
+	}
+	if *slowQuery > 0 {
+		log.Printf("[INFO] slow query log %s", *slowQuery)
+	}
+	if *failRate > 0 {
+		log.Printf("[INFO] fail rate %.3f of /reserve and /commit (seed %d, delay %s)", *failRate, *failSeed, *failDelay)
+	}
+	log.Printf("[INFO] db max open %d, max idle %d, conn max lifetime %s", *dbMaxOpen, *dbMaxIdle, *dbConnMaxLifetime)
+	handler := server
 	if AxLog {
-		log.Fatal(http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			server.ServeHTTP(w, r)
 			elapsed := time.Now().Sub(start)
 			log.Printf("%s\t%s\t%s\t%.5f", start.Format("2006-01-02T15:04:05.000"), r.Method, r.URL.Path, elapsed.Seconds())
-		})))
+		})
+	}
+	ln, err := listen(addr, *socket)
+	if err != nil {
+		log.Fatalf("listen failed. err: %s", err)
+	}
+	log.Printf("[INFO] start server %s (tls: %v)", ln.Addr(), useTLS)
+	srv := &http.Server{Addr: addr, Handler: inflightHandler(handler)}
+	var redirect *http.Server
+	if *httpRedirect != "" {
+		redirect = &http.Server{Addr: *httpRedirect, Handler: httpsRedirectHandler(*port)}
+		go func() {
+			log.Printf("[INFO] start https redirect %s", *httpRedirect)
+			if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// SIGTERM/SIGINT を受けたら処理中のリクエスト(transaction)の終了を待ってから止まる
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		s := <-sig
+		log.Printf("[INFO] shutdown by %s. in flight requests: %d", s, atomic.LoadInt64(&inflight))
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("[WARN] shutdown failed. err: %s", err)
+		}
+		if redirect != nil {
+			if err := redirect.Shutdown(ctx); err != nil {
+				log.Printf("[WARN] shutdown https redirect failed. err: %s", err)
+			}
+		}
+		close(shutdown)
+	}()
+	if useTLS {
+		err = srv.ServeTLS(ln, *tlsCert, *tlsKey)
 	} else {
-		log.Fatal(http.ListenAndServe(addr, server))
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
+	if *socket != "" {
+		// UnixListener は Close で消しますが、念のため残っていれば消しておく
+		if err := os.Remove(*socket); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] remove socket failed. err: %s", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("[WARN] db close failed. err: %s", err)
+	}
+	if replica != nil {
+		if err := replica.Close(); err != nil {
+			log.Printf("[WARN] replica close failed. err: %s", err)
+		}
+	}
+	if err := audit.Close(); err != nil {
+		log.Printf("[WARN] audit log close failed. err: %s", err)
+	}
+	log.Printf("[INFO] server stopped")
+}
+
+// listen は socket が指定されていれば unix domain socket で、なければ addr の tcp で listen します
+// 前回の異常終了で socket のファイルが残っていると listen できないので消してから listen します
+func listen(addr, socket string) (net.Listener, error) {
+	if socket == "" {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", socket)
+}
+
+// httpsRedirectHandler は同じ host の port の HTTPS に redirect します
+// POST の body を送り直してもらえるように 308 を返します
+func httpsRedirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(port))
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// waitDB は MySQL が起動するまで exponential backoff で db.Ping を繰り返します
+// sql.Open は接続しないので docker-compose で同時に起動すると最初のリクエストが失敗するためです
+func waitDB(db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	wait := 100 * time.Millisecond
+	for {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return errors.Wrapf(err, "gave up after %s", timeout)
+		}
+		log.Printf("[INFO] waiting for mysql (retry after %s). err: %s", wait, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+	}
+}
+
+// ReserveGCBatchSize は gcReserves が1回の DELETE で消す行数です。長時間lockしないように小分けにします
+const ReserveGCBatchSize = 1000
+
+// gcReserves は期限が切れてから -reserve-ttl 以上経った予約を定期的に削除します
+// commit/cancel されないまま残った予約で is_minus の集計が遅くならないようにするためです
+func gcReserves(db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var reaped int64
+		border := time.Now().Add(-*reserveTTL - *expiryGrace)
+		for {
+			res, err := db.Exec(`DELETE FROM reserve WHERE expire_at < ? LIMIT ?`, border, ReserveGCBatchSize)
+			if err != nil {
+				log.Printf("[WARN] gc reserves failed. err: %s", err)
+				break
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				log.Printf("[WARN] gc reserves failed. err: %s", err)
+				break
+			}
+			reaped += n
+			if n < ReserveGCBatchSize {
+				break
+			}
+		}
+		if reaped > 0 {
+			log.Printf("[INFO] gc reserves reaped %d rows", reaped)
+		}
 	}
 }
 
+var inflight int64
+
+func inflightHandler(f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inflight, 1)
+		defer atomic.AddInt64(&inflight, -1)
+		f.ServeHTTP(w, r)
+	})
+}
+
 func NewServer(db *sql.DB) http.Handler {
+	return newServer(db, nil, realClock{}, nil)
+}
+
+// NewServerWithClock は予約の期限判定に clock を使う NewServer です
+func NewServerWithClock(db *sql.DB, clock Clock) http.Handler {
+	return newServer(db, nil, clock, nil)
+}
+
+// newServer は replica が nil でなければ読み込みだけの endpoint を replica に向けます
+// audit は main で -audit-log から開いたもので、nil の場合は記録しません
+func newServer(db, replica *sql.DB, clock Clock, audit *auditLogger) http.Handler {
 	server := http.NewServeMux()
 
-	h := &Handler{db}
-	server.HandleFunc("/register", h.Register)
-	server.HandleFunc("/add_credit", h.AddCredit)
-	server.HandleFunc("/credit", h.GetCredit)
-	server.HandleFunc("/initialize", h.Initialize)
-	server.HandleFunc("/check", sleepHandle(h.Check, 50*time.Millisecond))
-	server.HandleFunc("/reserve", sleepHandle(h.Reserve, 70*time.Millisecond))
-	server.HandleFunc("/commit", sleepHandle(h.Commit, 300*time.Millisecond))
-	server.HandleFunc("/cancel", sleepHandle(h.Cancel, 80*time.Millisecond))
+	var m *metrics
+	if *enableMetrics {
+		m = newMetrics(db, clock)
+		server.Handle("/metrics", m.handler())
+	}
+	handle := func(pattern string, f http.HandlerFunc) {
+		server.HandleFunc(pattern, m.instrument(pattern, f))
+	}
+	// 一覧の endpoint は大きくなることがあるので -enable-gzip の時は圧縮する
+	list := func(f http.HandlerFunc) http.HandlerFunc {
+		if !*enableGzip {
+			return f
+		}
+		return gzipHandler(GzipMinSize, f)
+	}
+
+	txOpts, err := parseTxIsolation(*txIsolation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h := &Handler{db: db, replica: replica, metrics: m, audit: audit, clock: clock, txOpts: txOpts, note: parseReserveNote(*noteFormat)}
+	var fi *faultInjector
+	if *failRate > 0 {
+		fi = newFaultInjector(*failRate, *failSeed, *failDelay)
+	}
+	handle("/register", h.Register)
+	handle("/register_bulk", h.RegisterBulk)
+	handle("/add_credit", h.AddCredit)
+	handle("/withdraw", h.Withdraw)
+	handle("/credit", h.GetCredit)
+	handle("/balance", h.Balance)
+	handle("/credit_history", list(h.CreditHistory))
+	handle("/initialize", h.Initialize)
+	handle("/healthz", h.Healthz)
+	handle("/time", h.Time)
+	handle("/stats", h.Stats)
+	if *enableReset {
+		handle("/reset", h.Reset)
+	}
+	if *enableExpire {
+		handle("/expire", h.Expire)
+	}
+	// 同時実行数の制限は transaction の部分だけにかけるので sleepHandle の内側に置く
+	limiter := func(name string, max int) *concurrencyLimiter {
+		l := newConcurrencyLimiter(max, *concurrentWait)
+		m.observeConcurrency(name, l)
+		return l
+	}
+	checkLimit := limiter("/check", *maxConcurrentCheck)
+	reserveLimit := limiter("/reserve", *maxConcurrentReserve)
+	commitLimit := limiter("/commit", *maxConcurrentCommit)
+	cancelLimit := limiter("/cancel", *maxConcurrentCancel)
+	handle("/check", sleepHandle(checkLimit.limit(h.Check), 50*time.Millisecond))
+	handle("/reserve", fi.inject("/reserve", sleepHandle(reserveLimit.limit(h.Reserve), 70*time.Millisecond)))
+	handle("/reserve_multi", sleepHandle(reserveLimit.limit(h.ReserveMulti), 70*time.Millisecond))
+	handle("/reserve_update", sleepHandle(reserveLimit.limit(h.ReserveUpdate), 70*time.Millisecond))
+	handle("/commit_check", h.CommitCheck)
+	handle("/commit", fi.inject("/commit", sleepHandle(commitLimit.limit(h.Commit), 300*time.Millisecond)))
+	handle("/charge", fi.inject("/charge", sleepHandle(commitLimit.limit(h.Charge), 300*time.Millisecond)))
+	handle("/transfer", sleepHandle(commitLimit.limit(h.Transfer), 300*time.Millisecond))
+	handle("/cancel", sleepHandle(cancelLimit.limit(h.Cancel), 80*time.Millisecond))
+	handle("/cancel_by_app", h.CancelByApp)
+	handle("/reserve_status", list(h.ReserveStatus))
+	handle("/reserves", list(h.Reserves))
 
 	// default 404
 	server.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[INFO] request not found %s", r.URL.RawPath)
+		logf(r, "info", "request not found. method: %s, path: %s, req_id: %s", r.Method, r.URL.Path, requestID(r))
 		Error(w, "Not found", 404)
 	})
 
-	return authHandler(server)
+	var handler http.Handler = server
+	if *rateLimit > 0 {
+		handler = rateLimitHandler(newRateLimiter(*rateLimit, *rateBurst), handler)
+	}
+	if *hmacSecret != "" {
+		handler = signatureHandler([]byte(*hmacSecret), handler)
+	}
+	return requestIDHandler(recoverHandler(serverTimingHandler(serverTimeoutHandler(*serverTimeout, authHandler(bodyLimitHandler(*maxBody, handler))))))
+}
+
+// requestIDHandler はリクエストごとに X-Request-ID を割り当てます
+// ヘッダで指定されていればそれを引き継ぎ、なければ生成します
+func requestIDHandler(f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), RequestIDCtxKey, id)
+		f.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// recoverHandler は handler の panic を stack と一緒にログに出し、request id 付きの JSON の 500 を返します
+// txScope の外で panic しても他のリクエストに影響しないようにするためです
+func recoverHandler(f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			e := recover()
+			if e == nil {
+				return
+			}
+			if e == http.ErrAbortHandler {
+				// 接続を切るための panic なのでそのまま net/http に任せる
+				panic(e)
+			}
+			logf(r, "error", "panic: %v, path: %s\n%s", e, r.URL.Path, debug.Stack())
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(struct {
+				Error     string `json:"error"`
+				Code      string `json:"code"`
+				RequestID string `json:"request_id"`
+			}{"internal server error", "internal_server_error", requestID(r)})
+		}()
+		f.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(RequestIDCtxKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+var jsonLogger = log.New(os.Stderr, "", 0)
+
+// logf はリクエストに紐づくログを -log-format に従って出力します
+// text の場合は従来通り "[WARN] ..." の形式です
+func logf(r *http.Request, level, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if *logFormat != "json" {
+		log.Printf("[%s] %s", strings.ToUpper(level), msg)
+		return
+	}
+	b, err := json.Marshal(struct {
+		Time     string `json:"time"`
+		Level    string `json:"level"`
+		ReqID    string `json:"req_id"`
+		Endpoint string `json:"endpoint"`
+		Msg      string `json:"msg"`
+	}{
+		Time:     time.Now().Format(time.RFC3339Nano),
+		Level:    level,
+		ReqID:    requestID(r),
+		Endpoint: r.URL.Path,
+		Msg:      msg,
+	})
+	if err != nil {
+		log.Printf("[%s] %s", strings.ToUpper(level), msg)
+		return
+	}
+	jsonLogger.Println(string(b))
+}
+
+// bodyLimitHandler は max を超える body のリクエストを 413 で拒否します
+// 後段の json.Decoder や signatureHandler が巨大な body を読み込まないように先に読み切ります
+func bodyLimitHandler(max int64, f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			f.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > max {
+			ErrorWithCode(w, fmt.Sprintf("request body must be less than or equal to %d bytes", max), "request_too_large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max))
+		r.Body.Close()
+		if err != nil {
+			ErrorWithCode(w, fmt.Sprintf("request body must be less than or equal to %d bytes", max), "request_too_large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		f.ServeHTTP(w, r)
+	})
+}
+
+// signatureHandler は X-Signature が body の HMAC-SHA256 (hex) と一致するか検証します
+// handler が body を decode できるように読み取った body は戻しておきます
+func signatureHandler(secret []byte, f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			b, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				Error(w, "can't read body", http.StatusBadRequest)
+				return
+			}
+			body = b
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		sig, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+		if err != nil || len(sig) == 0 {
+			ErrorWithCode(w, "signature is invalid", "bad_signature", http.StatusUnauthorized)
+			return
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			ErrorWithCode(w, "signature is invalid", "bad_signature", http.StatusUnauthorized)
+			return
+		}
+		f.ServeHTTP(w, r)
+	})
 }
 
 func authHandler(f http.Handler) http.Handler {
@@ -108,11 +627,24 @@ func authHandler(f http.Handler) http.Handler {
 
 func sleepHandle(f http.HandlerFunc, sleep time.Duration) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(sleep)
+		// transactionの外で眠るのでロックは保持しない
+		time.Sleep(sleep + additionalLatency())
 		f.ServeHTTP(w, r)
 	})
 }
 
+// additionalLatency は -latency と -latency-jitter から追加の遅延時間を決めます
+func additionalLatency() time.Duration {
+	d := *latency
+	if j := int64(*latencyJitter); j > 0 {
+		d += time.Duration(rand.Int63n(2*j+1) - j)
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
 func appID(r *http.Request) (string, error) {
 	v := r.Context().Value(AppIDCtxKey)
 	if v == nil {
@@ -129,22 +661,110 @@ var (
 	CreditIsInsufficient      = errors.New("credit is insufficient")
 	ReserveIsExpires          = errors.New("reserve is already expired")
 	ReserveIsAlreadyCommitted = errors.New("reserve is already committed")
+	CreditIsAlreadyAdded      = errors.New("credit is already added")
+	CreditCapExceeded         = errors.New("credit cap is exceeded")
+	TooManyReserves           = errors.New("too many reserves")
 )
 
+// errorCodes は業務エラーに対応する機械判読用のエラーコードです
+var errorCodes = map[error]string{
+	CreditIsInsufficient:      "insufficient_credit",
+	ReserveIsExpires:          "reserve_expired",
+	ReserveIsAlreadyCommitted: "reserve_already_committed",
+	CreditCapExceeded:         "credit_cap_exceeded",
+	TooManyReserves:           "too_many_reserves",
+}
+
+// statusErrorCodes は業務エラー以外のエラーに status code から割り当てるエラーコードです
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusInternalServerError: "internal_server_error",
+}
+
 func Error(w http.ResponseWriter, err string, code int) {
+	errCode, ok := statusErrorCodes[code]
+	if !ok {
+		errCode = "error"
+	}
+	ErrorWithCode(w, err, errCode, code)
+}
+
+// ErrorWithCode は人間向けの error と機械判読用の code を返します
+func ErrorWithCode(w http.ResponseWriter, err, errCode string, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(code)
-	fmt.Fprintln(w, fmt.Sprintf(ResError, err))
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}{err, errCode})
+}
+
+// BusinessError は errorCodes に定義された業務エラーを返します
+func BusinessError(w http.ResponseWriter, err error, code int) {
+	errCode, ok := errorCodes[err]
+	if !ok {
+		Error(w, err.Error(), code)
+		return
+	}
+	ErrorWithCode(w, err.Error(), errCode, code)
+}
+
+// BadBody は body を読めなかった時のエラーを返します
+// price の形式の誤りは理由が分かるように invalid_price で返します
+func BadBody(w http.ResponseWriter, err error) {
+	if e, ok := err.(*PriceError); ok {
+		ErrorWithCode(w, e.Error(), "invalid_price", http.StatusBadRequest)
+		return
+	}
+	Error(w, "can't parse body", http.StatusBadRequest)
 }
 
+// PriceTooLarge は -max-price を超える price を拒否します
+// SUM(amount) の集計が溢れないようにするためです
+func PriceTooLarge(w http.ResponseWriter) {
+	ErrorWithCode(w, fmt.Sprintf("price must be lower than or equal to %d", *maxPrice), "price_too_large", http.StatusBadRequest)
+}
+
+// Success は {"status":"ok"} を返します
 func Success(w http.ResponseWriter) {
+	SuccessWith(w, nil)
+}
+
+// SuccessWith は {"status":"ok"} に fields を加えて返します
+// 成功レスポンスの形を揃えるために、文字列を組み立てずにこれを使ってください
+func SuccessWith(w http.ResponseWriter, fields map[string]interface{}) {
+	res := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		res[k] = v
+	}
+	res["status"] = "ok"
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	fmt.Fprintln(w, ResOK)
+	json.NewEncoder(w).Encode(res)
 }
 
 type Handler struct {
-	db *sql.DB
+	db      *sql.DB
+	replica *sql.DB
+	metrics *metrics
+	audit   *auditLogger
+	clock   Clock
+	txOpts  *sql.TxOptions
+	note    *template.Template
+
+	statsMu sync.Mutex
+	statsAt time.Time
+	stats   *bankStats
+}
+
+type bankStats struct {
+	Users           int64 `json:"users"`
+	TotalCredit     int64 `json:"total_credit"`
+	ActiveReserves  int64 `json:"active_reserves"`
+	ExpiredReserves int64 `json:"expired_reserves"`
 }
 
 // Register は POST /register を処理
@@ -166,204 +786,1130 @@ func (s *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		Error(w, "bank_id is required", http.StatusBadRequest)
 		return
 	}
-	if _, err := s.db.Exec(`INSERT INTO user (bank_id, created_at) VALUES (?, NOW(6))`, req.BankID); err != nil {
+	if _, err := s.db.ExecContext(r.Context(), `INSERT INTO user (bank_id, created_at) VALUES (?, NOW(6))`, req.BankID); err != nil {
 		if mysqlError, ok := err.(*mysql.MySQLError); ok {
 			if mysqlError.Number == 1062 {
-				Error(w, "bank_id already exists", http.StatusBadRequest)
+				ErrorWithCode(w, "bank_id already exists", "user_already_exists", http.StatusBadRequest)
 				return
 			}
 		}
-		log.Printf("[WARN] insert user failed. err: %s", err)
+		logf(r, "warn", "insert user failed. err: %s", err)
 		Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 	Success(w)
 }
 
-// AddCredit は POST /add_credit を処理
-// とても簡単に残高を増やすことができます。本当の銀行ならこんなAPIは無いと思いますが...
-func (s *Handler) AddCredit(w http.ResponseWriter, r *http.Request) {
+// RegisterBulk は POST /register_bulk を処理
+// bench の準備用に複数のユーザーを1回の INSERT で作成します。既に存在する bank_id は skip します
+func (s *Handler) RegisterBulk(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	type ReqPram struct {
-		BankID string `json:"bank_id"`
-		Price  int64  `json:"price"`
+	type ReqParam struct {
+		BankIDs []string `json:"bank_ids"`
 	}
-	req := &ReqPram{}
+	req := &ReqParam{}
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		Error(w, "can't parse body", http.StatusBadRequest)
 		return
 	}
-	if req.Price <= 0 {
-		Error(w, "price must be upper than 0", http.StatusBadRequest)
+	l := len(req.BankIDs)
+	if l == 0 {
+		Error(w, "bank_ids is required", http.StatusBadRequest)
 		return
 	}
-	userID := s.filterBankID(w, req.BankID)
-	if userID <= 0 {
+	if l > *registerBulkMax {
+		Error(w, fmt.Sprintf("bank_ids must be less than or equal to %d", *registerBulkMax), http.StatusBadRequest)
 		return
 	}
-	err := s.txScope(func(tx *sql.Tx) error {
-		if _, err := tx.Exec(`SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID); err != nil {
-			return errors.Wrap(err, "select lock failed")
+	args := make([]interface{}, 0, l)
+	for _, bankID := range req.BankIDs {
+		if bankID == "" {
+			Error(w, "bank_id is required", http.StatusBadRequest)
+			return
 		}
-		return s.modifyCredit(tx, userID, req.Price, "by add credit API")
-	})
+		args = append(args, bankID)
+	}
+	holder := "(?, NOW(6))" + strings.Repeat(", (?, NOW(6))", l-1)
+	res, err := s.db.ExecContext(r.Context(), `INSERT IGNORE INTO user (bank_id, created_at) VALUES `+holder, args...)
 	if err != nil {
-		log.Printf("[WARN] addCredit failed. err: %s", err)
+		logf(r, "warn", "insert users failed. err: %s", err)
 		Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-	Success(w)
-}
-
-// GetCredit は Get /credit を処理
-// ユーザーの残高をこっそり確認できます
-func (s *Handler) GetCredit(w http.ResponseWriter, r *http.Request) {
-	bankID := r.URL.Query().Get("bank_id")
-	userID := s.filterBankID(w, bankID)
-	if userID <= 0 {
-		return
-	}
-	var credit int64
-	if err := s.db.QueryRow(`SELECT credit FROM user WHERE id = ? LIMIT 1`, userID).Scan(&credit); err != nil {
-		Error(w, fmt.Sprintf("select credit failed. err:%s", err.Error()), http.StatusInternalServerError)
+	created, err := res.RowsAffected()
+	if err != nil {
+		logf(r, "warn", "rows affected failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	fmt.Fprintln(w, fmt.Sprintf(`{"credit":%d}`, credit))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"created": created,
+		"skipped": int64(l) - created,
+	})
 }
 
-// Check は POST /check を処理
-// 確定済み要求金額を保有しているかどうかを確認します
-func (s *Handler) Check(w http.ResponseWriter, r *http.Request) {
+// AddCredit は POST /add_credit を処理
+// とても簡単に残高を増やすことができます。本当の銀行ならこんなAPIは無いと思いますが...
+func (s *Handler) AddCredit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	_, err := appID(r)
-	if err != nil {
-		Error(w, err.Error(), http.StatusForbidden)
-		return
-	}
 	type ReqPram struct {
-		BankID string `json:"bank_id"`
-		Price  int64  `json:"price"`
+		BankID         string `json:"bank_id"`
+		Price          Price  `json:"price"`
+		IdempotencyKey string `json:"idempotency_key"`
 	}
 	req := &ReqPram{}
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		Error(w, "can't parse body", http.StatusBadRequest)
+		BadBody(w, err)
 		return
 	}
-	if req.Price < 0 {
-		Error(w, "price must be upper 0", http.StatusBadRequest)
+	if req.Price <= 0 {
+		Error(w, "price must be upper than 0", http.StatusBadRequest)
 		return
 	}
-	userID := s.filterBankID(w, req.BankID)
-	if userID <= 0 {
+	if int64(req.Price) > *maxPrice {
+		PriceTooLarge(w)
 		return
 	}
-	if req.Price == 0 {
-		Success(w)
+	userID := s.filterBankID(w, r, req.BankID)
+	if userID <= 0 {
 		return
 	}
-	err = s.txScope(func(tx *sql.Tx) error {
-		var credit int64
-		if err := tx.QueryRow(`SELECT credit FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID).Scan(&credit); err != nil {
-			return errors.Wrap(err, "select credit failed")
+	err := s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID); err != nil {
+			return errors.Wrap(err, "select lock failed")
 		}
-		if credit < req.Price {
-			return CreditIsInsufficient
+		if req.IdempotencyKey != "" {
+			if err := s.useIdempotencyKey(ctx, tx, userID, req.IdempotencyKey); err != nil {
+				return err
+			}
 		}
-		return nil
+		_, err := s.modifyCredit(ctx, tx, userID, int64(req.Price), "by add credit API")
+		return err
 	})
-	switch {
-	case err == CreditIsInsufficient:
-		Error(w, "credit is insufficient", http.StatusBadRequest)
-	case err != nil:
-		log.Printf("[WARN] check failed. err: %s", err)
+	if err == CreditIsAlreadyAdded {
+		// リトライされたリクエストなので最初のリクエストと同じく成功を返す
+		logf(r, "info", "addCredit skipped. idempotency_key: %s", req.IdempotencyKey)
+		err = nil
+	}
+	if err == CreditCapExceeded {
+		BusinessError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logf(r, "warn", "addCredit failed. err: %s", err)
 		Error(w, "internal server error", http.StatusInternalServerError)
-	default:
-		Success(w)
+		return
 	}
+	Success(w)
 }
 
-// Reserve は POST /reserve を処理
-// 複数の取引をまとめるために1分間以内のCommitを保証します
-func (s *Handler) Reserve(w http.ResponseWriter, r *http.Request) {
+// Withdraw は POST /withdraw を処理
+// テストの準備用にユーザーの残高を直接減らします。有効な予約(is_minus)の分は引き出せません
+func (s *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	appid, err := appID(r)
-	if err != nil {
-		Error(w, err.Error(), http.StatusForbidden)
+	type ReqPram struct {
+		BankID string `json:"bank_id"`
+		Price  Price  `json:"price"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadBody(w, err)
+		return
+	}
+	if req.Price <= 0 {
+		Error(w, "price must be upper than 0", http.StatusBadRequest)
+		return
+	}
+	if int64(req.Price) > *maxPrice {
+		PriceTooLarge(w)
+		return
+	}
+	userID := s.filterBankID(w, r, req.BankID)
+	if userID <= 0 {
+		return
+	}
+	err := s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID); err != nil {
+			return errors.Wrap(err, "select lock failed")
+		}
+		available, err := s.availableCredit(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if available-int64(req.Price) < 0 {
+			return CreditIsInsufficient
+		}
+		_, err = s.modifyCredit(ctx, tx, userID, -int64(req.Price), "by withdraw API")
+		return err
+	})
+	switch {
+	case err == CreditIsInsufficient:
+		BusinessError(w, CreditIsInsufficient, http.StatusBadRequest)
+	case err != nil:
+		logf(r, "warn", "withdraw failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		Success(w)
+	}
+}
+
+// GetCredit は Get /credit を処理
+// ユーザーの残高をこっそり確認できます
+func (s *Handler) GetCredit(w http.ResponseWriter, r *http.Request) {
+	bankID := r.URL.Query().Get("bank_id")
+	userID := s.filterBankID(w, r, bankID)
+	if userID <= 0 {
+		return
+	}
+	var credit int64
+	if err := s.readDB().QueryRowContext(r.Context(), `SELECT credit FROM user WHERE id = ? LIMIT 1`, userID).Scan(&credit); err != nil {
+		Error(w, fmt.Sprintf("select credit failed. err:%s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	SuccessWith(w, map[string]interface{}{"credit": credit})
+}
+
+// Balance は POST /balance (または GET /balance?bank_id=) を処理
+// 確定済みの残高と、有効な出金予約によって確保されている金額(reserved)を返します
+func (s *Handler) Balance(w http.ResponseWriter, r *http.Request) {
+	var bankID string
+	switch r.Method {
+	case http.MethodGet:
+		bankID = r.URL.Query().Get("bank_id")
+	case http.MethodPost:
+		type ReqParam struct {
+			BankID string `json:"bank_id"`
+		}
+		req := &ReqParam{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			Error(w, "can't parse body", http.StatusBadRequest)
+			return
+		}
+		bankID = req.BankID
+	default:
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := s.filterBankID(w, r, bankID)
+	if userID <= 0 {
+		return
+	}
+	var credit, reserved int64
+	if err := s.readDB().QueryRowContext(r.Context(), `SELECT credit FROM user WHERE id = ? LIMIT 1`, userID).Scan(&credit); err != nil {
+		logf(r, "warn", "select credit failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	query := `SELECT IFNULL(SUM(amount), 0) FROM reserve WHERE user_id = ? AND is_minus = 1 AND expire_at >= ?`
+	if err := s.readDB().QueryRowContext(r.Context(), query, userID, s.expiryBorder()).Scan(&reserved); err != nil {
+		logf(r, "warn", "calc reserve failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	// is_minusの予約はamountが負なので確保額として正に直す
+	SuccessWith(w, map[string]interface{}{"credit": credit, "reserved": -reserved})
+}
+
+// CreditHistory は POST /credit_history を処理
+// creditの履歴をid降順で返します。続きは before_id に最後のidを指定して取得します
+func (s *Handler) CreditHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type ReqParam struct {
+		BankID   string `json:"bank_id"`
+		Limit    int    `json:"limit"`
+		BeforeID int64  `json:"before_id"`
+	}
+	req := &ReqParam{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		Error(w, "can't parse body", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Limit < 0:
+		Error(w, "limit must be upper than 0", http.StatusBadRequest)
+		return
+	case req.Limit == 0:
+		req.Limit = CreditHistoryDefaultLimit
+	case req.Limit > CreditHistoryMaxLimit:
+		req.Limit = CreditHistoryMaxLimit
+	}
+	userID := s.filterBankID(w, r, req.BankID)
+	if userID <= 0 {
+		return
+	}
+	type Credit struct {
+		ID        int64     `json:"id"`
+		Amount    int64     `json:"amount"`
+		Note      string    `json:"note"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	query := `SELECT id, amount, note, created_at FROM credit WHERE user_id = ? ORDER BY id DESC LIMIT ?`
+	args := []interface{}{userID, req.Limit}
+	if req.BeforeID > 0 {
+		query = `SELECT id, amount, note, created_at FROM credit WHERE user_id = ? AND id < ? ORDER BY id DESC LIMIT ?`
+		args = []interface{}{userID, req.BeforeID, req.Limit}
+	}
+	rows, err := s.readDB().QueryContext(r.Context(), query, args...)
+	if err != nil {
+		logf(r, "warn", "select credit history failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	credits := make([]Credit, 0, req.Limit)
+	for rows.Next() {
+		var c Credit
+		if err := rows.Scan(&c.ID, &c.Amount, &c.Note, &c.CreatedAt); err != nil {
+			logf(r, "warn", "select credit history failed. err: %s", err)
+			Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		credits = append(credits, c)
+	}
+	if err = rows.Err(); err != nil {
+		logf(r, "warn", "select credit history failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"credits": credits,
+	})
+}
+
+// Check は POST /check を処理
+// 確定済み要求金額を保有しているかどうかを確認します
+// exact が指定されなければ user.credit を lock せずに(replica があれば replica で)読みます
+// 処理中の add_credit や commit の結果が反映される前の残高で判定することがありますが、
+// /check は何も変更しないので、予約や確定の時点では改めて lock して検証されます
+func (s *Handler) Check(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := appID(r)
+	if err != nil {
+		Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 	type ReqPram struct {
 		BankID string `json:"bank_id"`
-		Price  int64  `json:"price"`
+		Price  Price  `json:"price"`
+		Exact  bool   `json:"exact"`
 	}
 	req := &ReqPram{}
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		Error(w, "can't parse body", http.StatusBadRequest)
+		BadBody(w, err)
+		return
+	}
+	if req.Price < 0 {
+		Error(w, "price must be upper 0", http.StatusBadRequest)
+		return
+	}
+	if int64(req.Price) > *maxPrice {
+		PriceTooLarge(w)
+		return
+	}
+	userID := s.filterBankID(w, r, req.BankID)
+	if userID <= 0 {
+		return
+	}
+	if req.Price == 0 {
+		Success(w)
+		return
+	}
+	if req.Exact {
+		err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+			var credit int64
+			if err := tx.QueryRowContext(ctx, `SELECT credit FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID).Scan(&credit); err != nil {
+				return errors.Wrap(err, "select credit failed")
+			}
+			if credit < int64(req.Price) {
+				return CreditIsInsufficient
+			}
+			return nil
+		})
+	} else {
+		var credit int64
+		if err = s.readDB().QueryRowContext(r.Context(), `SELECT credit FROM user WHERE id = ? LIMIT 1`, userID).Scan(&credit); err != nil {
+			err = errors.Wrap(err, "select credit failed")
+		} else if credit < int64(req.Price) {
+			err = CreditIsInsufficient
+		}
+	}
+	switch {
+	case err == CreditIsInsufficient:
+		s.metrics.observeRejection("/check", err)
+		BusinessError(w, CreditIsInsufficient, http.StatusBadRequest)
+	case err != nil:
+		logf(r, "warn", "check failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		Success(w)
+	}
+}
+
+// Reserve は POST /reserve を処理
+// 複数の取引をまとめるために -reserve-ttl (default 5分) 以内のCommitを保証します
+// 期限は expire_at に保存されるので、Commit側の expire_at >= 現在時刻(Handler.clock) のチェックや
+// is_minus の合計の計算はそのままで新しい期限に従います
+func (s *Handler) Reserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appid, err := appID(r)
+	if err != nil {
+		Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	type ReqPram struct {
+		BankID string `json:"bank_id"`
+		Price  Price  `json:"price"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadBody(w, err)
 		return
 	}
 	if req.Price == 0 {
 		Error(w, "price is 0", http.StatusBadRequest)
 		return
 	}
-	userID := s.filterBankID(w, req.BankID)
+	if int64(req.Price) > *maxPrice || int64(req.Price) < -*maxPrice {
+		PriceTooLarge(w)
+		return
+	}
+	userID := s.filterBankID(w, r, req.BankID)
 	if userID <= 0 {
 		return
 	}
 	var rsvID int64
-	price := req.Price
-	memo := fmt.Sprintf("app:%s, price:%d", appid, req.Price)
-	err = s.txScope(func(tx *sql.Tx) error {
-		if _, err := tx.Exec(`SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID); err != nil {
+	var expire time.Time
+	price := int64(req.Price)
+	memo := s.reserveNote(appid, req.BankID, price)
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID); err != nil {
+			return errors.Wrap(err, "select lock failed")
+		}
+		var err error
+		rsvID, expire, err = s.insertReserve(ctx, tx, userID, price, appid, memo)
+		return err
+	})
+
+	switch {
+	case err == CreditIsInsufficient || err == TooManyReserves:
+		s.metrics.observeRejection("/reserve", err)
+		BusinessError(w, err, http.StatusBadRequest)
+	case err != nil:
+		logf(r, "warn", "reserve failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		SuccessWith(w, map[string]interface{}{"reserve_id": rsvID, "expire_at": expire.Format(time.RFC3339)})
+	}
+}
+
+// insertReserve は予約を作成して予約IDと期限を返します。userのlockは呼び出し側で取得してください
+// -max-reserves-per-user を超える場合は TooManyReserves を返します
+func (s *Handler) insertReserve(ctx context.Context, tx *queryTx, userID, price int64, appid, memo string) (int64, time.Time, error) {
+	now := s.clock.Now()
+	expire := now.Add(*reserveTTL)
+	border := s.expiryBorder()
+	if *maxReserves > 0 {
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(id) FROM reserve WHERE user_id = ? AND expire_at >= ?`, userID, border).Scan(&count); err != nil {
+			return 0, expire, errors.Wrap(err, "count reserve failed")
+		}
+		if count >= *maxReserves {
+			return 0, expire, TooManyReserves
+		}
+	}
+	isMinus := price < 0
+	if isMinus {
+		var fixed, reserved int64
+		if err := tx.QueryRowContext(ctx, `SELECT IFNULL(SUM(amount), 0) FROM credit WHERE user_id = ?`, userID).Scan(&fixed); err != nil {
+			return 0, expire, errors.Wrap(err, "calc credit failed")
+		}
+		if err := tx.QueryRowContext(ctx, `SELECT IFNULL(SUM(amount), 0) FROM reserve WHERE user_id = ? AND is_minus = 1 AND expire_at >= ?`, userID, border).Scan(&reserved); err != nil {
+			return 0, expire, errors.Wrap(err, "calc reserve failed")
+		}
+		if fixed+reserved+price < 0 {
+			return 0, expire, CreditIsInsufficient
+		}
+	}
+	query := `INSERT INTO reserve (user_id, app_id, amount, note, is_minus, created_at, expire_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	sr, err := tx.ExecContext(ctx, query, userID, appid, price, memo, isMinus, now, expire)
+	if err != nil {
+		return 0, expire, errors.Wrap(err, "update user.credit failed")
+	}
+	rsvID, err := sr.LastInsertId()
+	if err != nil {
+		return 0, expire, errors.Wrap(err, "lastInsertID failed")
+	}
+	return rsvID, expire, nil
+}
+
+// Charge は POST /charge を処理
+// 予約を作らずに reserve と commit を1つのtransactionで行います
+// app_id は Authorization header で受け取り、無ければ /cancel_by_app と同じく body の app_id を使います
+func (s *Handler) Charge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type ReqPram struct {
+		AppID  string `json:"app_id"`
+		BankID string `json:"bank_id"`
+		Price  Price  `json:"price"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadBody(w, err)
+		return
+	}
+	appid, err := appID(r)
+	if err != nil {
+		if req.AppID == "" {
+			Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		appid = req.AppID
+	}
+	if req.Price == 0 {
+		Error(w, "price is 0", http.StatusBadRequest)
+		return
+	}
+	if int64(req.Price) > *maxPrice || int64(req.Price) < -*maxPrice {
+		PriceTooLarge(w)
+		return
+	}
+	userID := s.filterBankID(w, r, req.BankID)
+	if userID <= 0 {
+		return
+	}
+	// commit と同じく予約の memo を残高の変動履歴に使う
+	memo := s.reserveNote(appid, req.BankID, int64(req.Price))
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID); err != nil {
 			return errors.Wrap(err, "select lock failed")
 		}
-		now := time.Now()
-		expire := now.Add(5 * time.Minute)
-		isMinus := price < 0
-		if isMinus {
-			var fixed, reserved int64
-			if err := tx.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM credit WHERE user_id = ?`, userID).Scan(&fixed); err != nil {
-				return errors.Wrap(err, "calc credit failed")
+		if req.Price < 0 {
+			available, err := s.availableCredit(ctx, tx, userID)
+			if err != nil {
+				return err
 			}
-			if err := tx.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM reserve WHERE user_id = ? AND is_minus = 1 AND expire_at >= ?`, userID, now).Scan(&reserved); err != nil {
-				return errors.Wrap(err, "calc reserve failed")
+			if available+int64(req.Price) < 0 {
+				return CreditIsInsufficient
 			}
-			if fixed+reserved+price < 0 {
+		}
+		_, err := s.modifyCredit(ctx, tx, userID, int64(req.Price), memo)
+		return err
+	})
+	switch {
+	case err == CreditIsInsufficient || err == CreditCapExceeded:
+		BusinessError(w, err, http.StatusBadRequest)
+	case err != nil:
+		logf(r, "warn", "charge failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		Success(w)
+	}
+}
+
+// Transfer は POST /transfer を処理
+// from_bank_id から to_bank_id へ price を1つのtransactionで移します
+// deadlock しないように2人の user の lock は id の順に取ります
+func (s *Handler) Transfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appid, err := appID(r)
+	if err != nil {
+		Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	type ReqPram struct {
+		FromBankID string `json:"from_bank_id"`
+		ToBankID   string `json:"to_bank_id"`
+		Price      Price  `json:"price"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadBody(w, err)
+		return
+	}
+	if req.Price <= 0 {
+		Error(w, "price must be positive", http.StatusBadRequest)
+		return
+	}
+	if int64(req.Price) > *maxPrice {
+		PriceTooLarge(w)
+		return
+	}
+	if req.FromBankID == req.ToBankID {
+		Error(w, "can't transfer to the same bank_id", http.StatusBadRequest)
+		return
+	}
+	fromID := s.filterBankID(w, r, req.FromBankID)
+	if fromID <= 0 {
+		return
+	}
+	toID := s.filterBankID(w, r, req.ToBankID)
+	if toID <= 0 {
+		return
+	}
+	price := int64(req.Price)
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM user WHERE id IN (?, ?) ORDER BY id FOR UPDATE`, fromID, toID); err != nil {
+			return errors.Wrap(err, "select lock failed")
+		}
+		available, err := s.availableCredit(ctx, tx, fromID)
+		if err != nil {
+			return err
+		}
+		if available < price {
+			return CreditIsInsufficient
+		}
+		if _, err := s.modifyCredit(ctx, tx, fromID, -price, fmt.Sprintf("app:%s, transfer to:%s, price:%d", appid, req.ToBankID, price)); err != nil {
+			return err
+		}
+		_, err = s.modifyCredit(ctx, tx, toID, price, fmt.Sprintf("app:%s, transfer from:%s, price:%d", appid, req.FromBankID, price))
+		return err
+	})
+	switch {
+	case err == CreditIsInsufficient || err == CreditCapExceeded:
+		BusinessError(w, err, http.StatusBadRequest)
+	case err != nil:
+		logf(r, "warn", "transfer failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		Success(w)
+	}
+}
+
+// availableCredit は残高から有効な予約(is_minus)の分を引いた使える金額を返します。userのlockは呼び出し側で取得してください
+func (s *Handler) availableCredit(ctx context.Context, tx *queryTx, userID int64) (int64, error) {
+	var fixed, reserved int64
+	if err := tx.QueryRowContext(ctx, `SELECT IFNULL(SUM(amount), 0) FROM credit WHERE user_id = ?`, userID).Scan(&fixed); err != nil {
+		return 0, errors.Wrap(err, "calc credit failed")
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT IFNULL(SUM(amount), 0) FROM reserve WHERE user_id = ? AND is_minus = 1 AND expire_at >= ?`, userID, s.expiryBorder()).Scan(&reserved); err != nil {
+		return 0, errors.Wrap(err, "calc reserve failed")
+	}
+	return fixed + reserved, nil
+}
+
+// ReserveUpdate は POST /reserve_update を処理
+// 有効な予約の金額を変更します。cancel してから reserve し直すと確保していた残高が一瞬使えてしまうので1つのtransactionで行います
+// 変更できるのは自分の app_id の予約だけで、他の app の予約や確定済みの予約は /commit と同じく reserve_already_committed になります
+func (s *Handler) ReserveUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appid, err := appID(r)
+	if err != nil {
+		Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	type ReqPram struct {
+		ReserveID int64 `json:"reserve_id"`
+		Price     Price `json:"price"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadBody(w, err)
+		return
+	}
+	if req.ReserveID <= 0 {
+		Error(w, "reserve_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.Price == 0 {
+		Error(w, "price is 0", http.StatusBadRequest)
+		return
+	}
+	if int64(req.Price) > *maxPrice || int64(req.Price) < -*maxPrice {
+		PriceTooLarge(w)
+		return
+	}
+	price := int64(req.Price)
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		// userのlockを先に取るために予約の持ち主を調べる
+		var userID int64
+		err := tx.QueryRowContext(ctx, `SELECT user_id FROM reserve WHERE id = ? AND app_id = ?`, req.ReserveID, appid).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return ReserveIsAlreadyCommitted
+		}
+		if err != nil {
+			return errors.Wrap(err, "select reserve failed")
+		}
+		var bankID string
+		if err := tx.QueryRowContext(ctx, `SELECT bank_id FROM user WHERE id = ? LIMIT 1 FOR UPDATE`, userID).Scan(&bankID); err != nil {
+			return errors.Wrap(err, "select lock failed")
+		}
+		var amount int64
+		var expire time.Time
+		query := `SELECT amount, expire_at FROM reserve WHERE id = ? AND user_id = ? FOR UPDATE`
+		err = tx.QueryRowContext(ctx, query, req.ReserveID, userID).Scan(&amount, &expire)
+		if err == sql.ErrNoRows {
+			// lock を待つ間に確定か取り消しがされた
+			return ReserveIsAlreadyCommitted
+		}
+		if err != nil {
+			return errors.Wrap(err, "select reserve failed")
+		}
+		if expire.Before(s.expiryBorder()) {
+			return ReserveIsExpires
+		}
+		if price < 0 {
+			available, err := s.availableCredit(ctx, tx, userID)
+			if err != nil {
+				return err
+			}
+			if amount < 0 {
+				// 変更前の予約で確保している分は使える
+				available -= amount
+			}
+			if available+price < 0 {
 				return CreditIsInsufficient
 			}
 		}
-		query := `INSERT INTO reserve (user_id, amount, note, is_minus, created_at, expire_at) VALUES (?, ?, ?, ?, ?, ?)`
-		sr, err := tx.Exec(query, userID, price, memo, isMinus, now, expire)
+		memo := s.reserveNote(appid, bankID, price)
+		if _, err := tx.ExecContext(ctx, `UPDATE reserve SET amount = ?, is_minus = ?, note = ? WHERE id = ?`, price, price < 0, memo, req.ReserveID); err != nil {
+			return errors.Wrap(err, "update reserve failed")
+		}
+		return nil
+	})
+	switch {
+	case err == CreditIsInsufficient || err == ReserveIsExpires:
+		BusinessError(w, err, http.StatusBadRequest)
+	case err == ReserveIsAlreadyCommitted:
+		BusinessError(w, err, http.StatusConflict)
+	case err != nil:
+		logf(r, "warn", "reserve update failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		Success(w)
+	}
+}
+
+// ReserveMulti は POST /reserve_multi を処理
+// 複数の予約を1つのtransactionで作成します。1つでも失敗した場合はすべて取り消されます
+func (s *Handler) ReserveMulti(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type Reserve struct {
+		BankID string `json:"bank_id"`
+		Price  Price  `json:"price"`
+	}
+	type ReqPram struct {
+		AppID    string    `json:"app_id"`
+		Reserves []Reserve `json:"reserves"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadBody(w, err)
+		return
+	}
+	appid, err := appID(r)
+	if err != nil {
+		if req.AppID == "" {
+			Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		appid = req.AppID
+	}
+	l := len(req.Reserves)
+	if l == 0 {
+		Error(w, "reserves is required", http.StatusBadRequest)
+		return
+	}
+	userIDs := make([]int64, l)
+	for i, rsv := range req.Reserves {
+		if rsv.Price == 0 {
+			Error(w, "price is 0", http.StatusBadRequest)
+			return
+		}
+		if int64(rsv.Price) > *maxPrice || int64(rsv.Price) < -*maxPrice {
+			PriceTooLarge(w)
+			return
+		}
+		if userIDs[i] = s.filterBankID(w, r, rsv.BankID); userIDs[i] <= 0 {
+			return
+		}
+	}
+	rsvIDs := make([]int64, l)
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		// デッドロックを避けるためにuserはid順にlockする
+		uniq := make(map[int64]bool, l)
+		lockIDs := make([]interface{}, 0, l)
+		for _, id := range userIDs {
+			if !uniq[id] {
+				uniq[id] = true
+				lockIDs = append(lockIDs, id)
+			}
+		}
+		holder := "?" + strings.Repeat(",?", len(lockIDs)-1)
+		query := fmt.Sprintf(`SELECT id FROM user WHERE id IN (%s) ORDER BY id FOR UPDATE`, holder)
+		if _, err := tx.ExecContext(ctx, query, lockIDs...); err != nil {
+			return errors.Wrap(err, "select lock failed")
+		}
+		for i, rsv := range req.Reserves {
+			memo := s.reserveNote(appid, rsv.BankID, int64(rsv.Price))
+			id, _, err := s.insertReserve(ctx, tx, userIDs[i], int64(rsv.Price), appid, memo)
+			if err != nil {
+				return err
+			}
+			rsvIDs[i] = id
+		}
+		return nil
+	})
+
+	switch {
+	case err == CreditIsInsufficient || err == TooManyReserves:
+		BusinessError(w, err, http.StatusBadRequest)
+	case err != nil:
+		logf(r, "warn", "reserve multi failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      "ok",
+			"reserve_ids": rsvIDs,
+		})
+	}
+}
+
+// CommitResult は verbose な /commit で返す、確定した予約ごとの適用後の残高です
+type CommitResult struct {
+	ReserveID int64 `json:"reserve_id"`
+	UserID    int64 `json:"user_id"`
+	Amount    int64 `json:"amount"`
+	Credit    int64 `json:"credit"`
+}
+
+// checkReserveIDs は /commit と /cancel の reserve_ids の個数を確認し、不正な場合はエラーを返して false を返します
+func checkReserveIDs(w http.ResponseWriter, ids []int64) bool {
+	if len(ids) == 0 {
+		Error(w, "reserve_ids is required", http.StatusBadRequest)
+		return false
+	}
+	if len(ids) > *maxReserveIDs {
+		ErrorWithCode(w, fmt.Sprintf("reserve_ids must be less than or equal to %d", *maxReserveIDs), "too_many_reserve_ids", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// queryer は *sql.DB と *queryTx のどちらからも読めるようにするためのものです
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// reserveIDs は予約を確定できる (valid)、期限切れ (expired)、存在しない (missing) に分けたものです
+// 確定済みや取り消し済みの予約は削除されているので missing になります
+type reserveIDs struct {
+	valid   []int64
+	expired []int64
+	missing []int64
+}
+
+// classifyReserves は ids を valid, expired, missing に分けます
+// /commit と /commit_check で同じ判定をするために使います
+// forUpdate は transaction の中で予約を lock して読みます。lock しない読み込みはその時点の snapshot を作るので、
+// user の lock を待つ間に他の transaction が commit した credit が modifyCredit から見えなくなるためです
+func (s *Handler) classifyReserves(ctx context.Context, q queryer, ids []int64, forUpdate bool) (*reserveIDs, error) {
+	l := len(ids)
+	holder := "?" + strings.Repeat(",?", l-1)
+	rids := make([]interface{}, l)
+	for i, v := range ids {
+		rids[i] = v
+	}
+	query := fmt.Sprintf(`SELECT id, expire_at FROM reserve WHERE id IN (%s)`, holder)
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	rows, err := q.QueryContext(ctx, query, rids...)
+	if err != nil {
+		return nil, errors.Wrap(err, "select reserves failed")
+	}
+	defer rows.Close()
+	expireAt := make(map[int64]time.Time, l)
+	for rows.Next() {
+		var id int64
+		var expire time.Time
+		if err := rows.Scan(&id, &expire); err != nil {
+			return nil, errors.Wrap(err, "select reserves failed")
+		}
+		expireAt[id] = expire
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select reserves failed")
+	}
+	border := s.expiryBorder()
+	res := &reserveIDs{
+		valid:   make([]int64, 0, l),
+		expired: []int64{},
+		missing: []int64{},
+	}
+	for _, id := range ids {
+		expire, ok := expireAt[id]
+		switch {
+		case !ok:
+			res.missing = append(res.missing, id)
+		case expire.Before(border):
+			res.expired = append(res.expired, id)
+		default:
+			res.valid = append(res.valid, id)
+		}
+	}
+	return res, nil
+}
+
+// CommitCheck は POST /commit_check を処理
+// /commit と同じ body を受け取り、確定せずに予約ごとに確定できるか (valid)、期限切れ (expired)、存在しない (missing) かを返します
+// lock は取らないので、返した後に他のリクエストで確定や取り消しがされることはあります
+func (s *Handler) CommitCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := appID(r)
+	if err != nil {
+		Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	type ReqPram struct {
+		ReserveIDs []int64 `json:"reserve_ids"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		Error(w, "can't parse body", http.StatusBadRequest)
+		return
+	}
+	if !checkReserveIDs(w, req.ReserveIDs) {
+		return
+	}
+	// replica は遅れることがあるので primary を読む
+	ids, err := s.classifyReserves(r.Context(), s.db, req.ReserveIDs, false)
+	if err != nil {
+		logf(r, "warn", "classify reserves failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	SuccessWith(w, map[string]interface{}{
+		"committable": len(ids.valid) == len(req.ReserveIDs),
+		"valid":       ids.valid,
+		"expired":     ids.expired,
+		"missing":     ids.missing,
+	})
+}
+
+// Commit は POST /commit を処理
+// allow_partial が指定された場合は期限切れや存在しない予約をスキップし、有効な予約のみを確定します
+// idempotent が指定された場合は、指定された予約が1件も残っていなければ成功を返します
+// 確定されたかどうかは確かめないので、存在しなかった予約や期限切れで -gc-interval に削除された予約でも成功になります
+// 確定済みの再送かを区別したい場合は idempotent を使わずに 409 を見てください
+// verbose が指定された場合は確定した予約ごとに user_id, amount と適用後の credit を返します
+func (s *Handler) Commit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := appID(r)
+	if err != nil {
+		Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	type ReqPram struct {
+		ReserveIDs   []int64 `json:"reserve_ids"`
+		AllowPartial bool    `json:"allow_partial"`
+		Idempotent   bool    `json:"idempotent"`
+		Verbose      bool    `json:"verbose"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		Error(w, "can't parse body", http.StatusBadRequest)
+		return
+	}
+	if !checkReserveIDs(w, req.ReserveIDs) {
+		return
+	}
+	s.observeBatch(r, "/commit", len(req.ReserveIDs))
+	var committed []int64
+	var results []CommitResult
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		// deadlock で retry された時のために前回の結果は捨てる
+		committed = make([]int64, 0, len(req.ReserveIDs))
+		results = make([]CommitResult, 0, len(req.ReserveIDs))
+		l := len(req.ReserveIDs)
+		holder := "?" + strings.Repeat(",?", l-1)
+		rids := make([]interface{}, l, l+1)
+		for i, v := range req.ReserveIDs {
+			rids[i] = v
+		}
+		border := s.expiryBorder()
+		if !req.AllowPartial {
+			// 空振りロックを避けるために /commit_check と同じ判定で事前チェック
+			ids, err := s.classifyReserves(ctx, tx, req.ReserveIDs, true)
+			if err != nil {
+				return err
+			}
+			if len(ids.missing) == l && req.Idempotent {
+				return nil
+			}
+			if len(ids.expired) > 0 {
+				return ReserveIsExpires
+			}
+			if len(ids.missing) > 0 {
+				return ReserveIsAlreadyCommitted
+			}
+		}
+
+		// reserveの取得(for update)
+		type Reserve struct {
+			ID     int64
+			UserID int64
+			Amount int64
+			Note   string
+		}
+		reserves := make([]Reserve, 0, l)
+		query := fmt.Sprintf(`SELECT id, user_id, amount, note FROM reserve WHERE id IN (%s) FOR UPDATE`, holder)
+		args := rids
+		if req.AllowPartial {
+			query = fmt.Sprintf(`SELECT id, user_id, amount, note FROM reserve WHERE id IN (%s) AND expire_at >= ? FOR UPDATE`, holder)
+			args = append(rids, border)
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
 		if err != nil {
-			return errors.Wrap(err, "update user.credit failed")
+			return errors.Wrap(err, "select reserves failed")
 		}
-		if rsvID, err = sr.LastInsertId(); err != nil {
-			return errors.Wrap(err, "lastInsertID failed")
+		defer rows.Close()
+		for rows.Next() {
+			reserve := Reserve{}
+			if err := rows.Scan(&reserve.ID, &reserve.UserID, &reserve.Amount, &reserve.Note); err != nil {
+				return errors.Wrap(err, "select reserves failed")
+			}
+			reserves = append(reserves, reserve)
+		}
+		if err = rows.Err(); err != nil {
+			return errors.Wrap(err, "select reserves failed")
+		}
+		if !req.AllowPartial && len(reserves) != l {
+			return ReserveIsAlreadyCommitted
+		}
+		if len(reserves) == 0 {
+			return nil
+		}
+
+		// userのlock (確定対象の予約を持つuserのみ)
+		cl := len(reserves)
+		cholder := "?" + strings.Repeat(",?", cl-1)
+		userids := make([]interface{}, cl)
+		cids := make([]interface{}, cl)
+		for i, rsv := range reserves {
+			userids[i] = rsv.UserID
+			cids[i] = rsv.ID
+		}
+		// deadlock しないように id の順にすべての user を lock する
+		query = fmt.Sprintf(`SELECT id FROM user WHERE id IN (%s) ORDER BY id FOR UPDATE`, cholder)
+		if _, err := tx.ExecContext(ctx, query, userids...); err != nil {
+			return errors.Wrap(err, "select lock failed")
+		}
+
+		// 予約のcreditへの適用
+		for _, rsv := range reserves {
+			credit, err := s.modifyCredit(ctx, tx, rsv.UserID, rsv.Amount, rsv.Note)
+			if err != nil {
+				return errors.Wrapf(err, "modifyCredit failed %#v", rsv)
+			}
+			results = append(results, CommitResult{rsv.ID, rsv.UserID, rsv.Amount, credit})
+		}
+
+		// reserveの削除
+		query = fmt.Sprintf(`DELETE FROM reserve WHERE id IN (%s)`, cholder)
+		if _, err := tx.ExecContext(ctx, query, cids...); err != nil {
+			return errors.Wrap(err, "delete reserve failed")
+		}
+		for _, rsv := range reserves {
+			committed = append(committed, rsv.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		switch errors.Cause(err) {
+		case ReserveIsExpires:
+			s.metrics.observeRejection("/commit", ReserveIsExpires)
+			BusinessError(w, err, http.StatusBadRequest)
+		case ReserveIsAlreadyCommitted:
+			s.metrics.observeRejection("/commit", ReserveIsAlreadyCommitted)
+			BusinessError(w, err, http.StatusConflict)
+		case CreditCapExceeded:
+			s.metrics.observeRejection("/commit", CreditCapExceeded)
+			BusinessError(w, CreditCapExceeded, http.StatusBadRequest)
+		default:
+			logf(r, "warn", "commit credit failed. err: %s", err)
+			Error(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !req.AllowPartial {
+		if req.Verbose {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "ok",
+				"results": results,
+			})
+			return
+		}
+		Success(w)
+		return
+	}
+	ok := make(map[int64]bool, len(committed))
+	for _, id := range committed {
+		ok[id] = true
+	}
+	skipped := make([]int64, 0, len(req.ReserveIDs)-len(committed))
+	for _, id := range req.ReserveIDs {
+		if !ok[id] {
+			skipped = append(skipped, id)
 		}
-		return nil
-	})
-
-	switch {
-	case err == CreditIsInsufficient:
-		Error(w, "credit is insufficient", http.StatusBadRequest)
-	case err != nil:
-		log.Printf("[WARN] reserve failed. err: %s", err)
-		Error(w, "internal server error", http.StatusInternalServerError)
-	default:
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		fmt.Fprintln(w, fmt.Sprintf(`{"reserve_id":%d}`, rsvID))
 	}
+	res := map[string]interface{}{
+		"status":    "ok",
+		"committed": committed,
+		"skipped":   skipped,
+	}
+	if req.Verbose {
+		res["results"] = results
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
 }
 
-func (s *Handler) Commit(w http.ResponseWriter, r *http.Request) {
+// Cancel は POST /cancel を処理
+// idempotent が指定された場合は、指定された予約が1件も残っていなければ取り消し済みの再送とみなして
+// {"status":"ok","cancelled":0} を返します
+func (s *Handler) Cancel(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -375,17 +1921,20 @@ func (s *Handler) Commit(w http.ResponseWriter, r *http.Request) {
 	}
 	type ReqPram struct {
 		ReserveIDs []int64 `json:"reserve_ids"`
+		Idempotent bool    `json:"idempotent"`
 	}
 	req := &ReqPram{}
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		Error(w, "can't parse body", http.StatusBadRequest)
 		return
 	}
-	if len(req.ReserveIDs) == 0 {
-		Error(w, "reserve_ids is required", http.StatusBadRequest)
+	if !checkReserveIDs(w, req.ReserveIDs) {
 		return
 	}
-	err = s.txScope(func(tx *sql.Tx) error {
+	s.observeBatch(r, "/cancel", len(req.ReserveIDs))
+	var cancelled int
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		cancelled = 0
 		l := len(req.ReserveIDs)
 		holder := "?" + strings.Repeat(",?", l-1)
 		rids := make([]interface{}, l)
@@ -394,31 +1943,32 @@ func (s *Handler) Commit(w http.ResponseWriter, r *http.Request) {
 		}
 		// 空振りロックを避けるために個数チェック
 		var count int
-		query := fmt.Sprintf(`SELECT COUNT(id) FROM reserve WHERE id IN (%s) AND expire_at >= NOW()`, holder)
-		if err := tx.QueryRow(query, rids...).Scan(&count); err != nil {
+		query := fmt.Sprintf(`SELECT COUNT(id) FROM reserve WHERE id IN (%s)`, holder)
+		if err := tx.QueryRowContext(ctx, query, rids...).Scan(&count); err != nil {
 			return errors.Wrap(err, "count reserve failed")
 		}
+		if count == 0 && req.Idempotent {
+			return nil
+		}
 		if count < l {
-			return ReserveIsExpires
+			return ReserveIsAlreadyCommitted
 		}
 
 		// reserveの取得(for update)
 		type Reserve struct {
 			ID     int64
 			UserID int64
-			Amount int64
-			Note   string
 		}
 		reserves := make([]Reserve, 0, l)
-		query = fmt.Sprintf(`SELECT id, user_id, amount, note FROM reserve WHERE id IN (%s) FOR UPDATE`, holder)
-		rows, err := tx.Query(query, rids...)
+		query = fmt.Sprintf(`SELECT id, user_id FROM reserve WHERE id IN (%s) FOR UPDATE`, holder)
+		rows, err := tx.QueryContext(ctx, query, rids...)
 		if err != nil {
 			return errors.Wrap(err, "select reserves failed")
 		}
 		defer rows.Close()
 		for rows.Next() {
 			reserve := Reserve{}
-			if err := rows.Scan(&reserve.ID, &reserve.UserID, &reserve.Amount, &reserve.Note); err != nil {
+			if err := rows.Scan(&reserve.ID, &reserve.UserID); err != nil {
 				return errors.Wrap(err, "select reserves failed")
 			}
 			reserves = append(reserves, reserve)
@@ -435,84 +1985,77 @@ func (s *Handler) Commit(w http.ResponseWriter, r *http.Request) {
 		for i, rsv := range reserves {
 			userids[i] = rsv.UserID
 		}
-		query = fmt.Sprintf(`SELECT id FROM user WHERE id IN (%s)  LIMIT 1 FOR UPDATE`, holder)
-		if _, err := tx.Exec(query, userids...); err != nil {
+		// deadlock しないように id の順にすべての user を lock する
+		query = fmt.Sprintf(`SELECT id FROM user WHERE id IN (%s) ORDER BY id FOR UPDATE`, holder)
+		if _, err := tx.ExecContext(ctx, query, userids...); err != nil {
 			return errors.Wrap(err, "select lock failed")
 		}
 
-		// 予約のcreditへの適用
-		for _, rsv := range reserves {
-			if err := s.modifyCredit(tx, rsv.UserID, rsv.Amount, rsv.Note); err != nil {
-				return errors.Wrapf(err, "modifyCredit failed %#v", rsv)
-			}
-		}
-
 		// reserveの削除
 		query = fmt.Sprintf(`DELETE FROM reserve WHERE id IN (%s)`, holder)
-		if _, err := tx.Exec(query, rids...); err != nil {
+		if _, err := tx.ExecContext(ctx, query, rids...); err != nil {
 			return errors.Wrap(err, "delete reserve failed")
 		}
+		cancelled = l
 		return nil
 	})
 	if err != nil {
-		if err == ReserveIsExpires || err == ReserveIsAlreadyCommitted {
-			Error(w, err.Error(), http.StatusBadRequest)
-		} else {
-			log.Printf("[WARN] commit credit failed. err: %s", err)
+		switch err {
+		case ReserveIsExpires:
+			s.metrics.observeRejection("/cancel", err)
+			BusinessError(w, err, http.StatusBadRequest)
+		case ReserveIsAlreadyCommitted:
+			s.metrics.observeRejection("/cancel", err)
+			BusinessError(w, err, http.StatusConflict)
+		default:
+			logf(r, "warn", "cancel credit failed. err: %s", err)
 			Error(w, "internal server error", http.StatusInternalServerError)
 		}
 		return
 	}
+	if req.Idempotent {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "ok",
+			"cancelled": cancelled,
+		})
+		return
+	}
 	Success(w)
 }
 
-func (s *Handler) Cancel(w http.ResponseWriter, r *http.Request) {
+// CancelByApp は POST /cancel_by_app を処理
+// app_id の有効な予約をすべて取り消し、取り消した件数を返します
+func (s *Handler) CancelByApp(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	_, err := appID(r)
-	if err != nil {
-		Error(w, err.Error(), http.StatusForbidden)
-		return
-	}
 	type ReqPram struct {
-		ReserveIDs []int64 `json:"reserve_ids"`
+		AppID string `json:"app_id"`
 	}
 	req := &ReqPram{}
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		Error(w, "can't parse body", http.StatusBadRequest)
 		return
 	}
-	if len(req.ReserveIDs) == 0 {
-		Error(w, "reserve_ids is required", http.StatusBadRequest)
-		return
-	}
-	err = s.txScope(func(tx *sql.Tx) error {
-		l := len(req.ReserveIDs)
-		holder := "?" + strings.Repeat(",?", l-1)
-		rids := make([]interface{}, l)
-		for i, v := range req.ReserveIDs {
-			rids[i] = v
-		}
-		// 空振りロックを避けるために個数チェック
-		var count int
-		query := fmt.Sprintf(`SELECT COUNT(id) FROM reserve WHERE id IN (%s)`, holder)
-		if err := tx.QueryRow(query, rids...).Scan(&count); err != nil {
-			return errors.Wrap(err, "count reserve failed")
-		}
-		if count < l {
-			return ReserveIsAlreadyCommitted
+	appid, err := appID(r)
+	if err != nil {
+		if req.AppID == "" {
+			Error(w, err.Error(), http.StatusForbidden)
+			return
 		}
-
+		appid = req.AppID
+	}
+	var cancelled int
+	err = s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
 		// reserveの取得(for update)
 		type Reserve struct {
 			ID     int64
 			UserID int64
 		}
-		reserves := make([]Reserve, 0, l)
-		query = fmt.Sprintf(`SELECT id, user_id FROM reserve WHERE id IN (%s) FOR UPDATE`, holder)
-		rows, err := tx.Query(query, rids...)
+		reserves := []Reserve{}
+		rows, err := tx.QueryContext(ctx, `SELECT id, user_id FROM reserve WHERE app_id = ? AND expire_at >= ? FOR UPDATE`, appid, s.expiryBorder())
 		if err != nil {
 			return errors.Wrap(err, "select reserves failed")
 		}
@@ -527,40 +2070,174 @@ func (s *Handler) Cancel(w http.ResponseWriter, r *http.Request) {
 		if err = rows.Err(); err != nil {
 			return errors.Wrap(err, "select reserves failed")
 		}
-		if len(reserves) != l {
-			return ReserveIsAlreadyCommitted
+		l := len(reserves)
+		if l == 0 {
+			return nil
 		}
 
 		// userのlock
+		holder := "?" + strings.Repeat(",?", l-1)
+		rids := make([]interface{}, l)
 		userids := make([]interface{}, l)
 		for i, rsv := range reserves {
+			rids[i] = rsv.ID
 			userids[i] = rsv.UserID
 		}
-		query = fmt.Sprintf(`SELECT id FROM user WHERE id IN (%s)  LIMIT 1 FOR UPDATE`, holder)
-		if _, err := tx.Exec(query, userids...); err != nil {
+		query := fmt.Sprintf(`SELECT id FROM user WHERE id IN (%s) ORDER BY id FOR UPDATE`, holder)
+		if _, err := tx.ExecContext(ctx, query, userids...); err != nil {
 			return errors.Wrap(err, "select lock failed")
 		}
 
 		// reserveの削除
 		query = fmt.Sprintf(`DELETE FROM reserve WHERE id IN (%s)`, holder)
-		if _, err := tx.Exec(query, rids...); err != nil {
+		if _, err := tx.ExecContext(ctx, query, rids...); err != nil {
 			return errors.Wrap(err, "delete reserve failed")
 		}
+		cancelled = l
 		return nil
 	})
 	if err != nil {
-		if err == ReserveIsExpires || err == ReserveIsAlreadyCommitted {
-			Error(w, err.Error(), http.StatusBadRequest)
+		logf(r, "warn", "cancel by app failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	SuccessWith(w, map[string]interface{}{"cancelled": cancelled})
+}
+
+// ReserveStatus は POST /reserve_status を処理
+// 予約ごとに active, expired, not_found (確定または取り消し済み) のいずれかを返します
+func (s *Handler) ReserveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type ReqPram struct {
+		ReserveIDs []int64 `json:"reserve_ids"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		Error(w, "can't parse body", http.StatusBadRequest)
+		return
+	}
+	l := len(req.ReserveIDs)
+	if l == 0 {
+		Error(w, "reserve_ids is required", http.StatusBadRequest)
+		return
+	}
+	type ReserveStatus struct {
+		ID       int64      `json:"id"`
+		Status   string     `json:"status"`
+		Amount   int64      `json:"amount,omitempty"`
+		ExpireAt *time.Time `json:"expire_at,omitempty"`
+	}
+	holder := "?" + strings.Repeat(",?", l-1)
+	rids := make([]interface{}, l)
+	for i, v := range req.ReserveIDs {
+		rids[i] = v
+	}
+	query := fmt.Sprintf(`SELECT id, amount, expire_at FROM reserve WHERE id IN (%s)`, holder)
+	rows, err := s.db.QueryContext(r.Context(), query, rids...)
+	if err != nil {
+		logf(r, "warn", "select reserves failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	border := s.expiryBorder()
+	found := make(map[int64]ReserveStatus, l)
+	for rows.Next() {
+		var rs ReserveStatus
+		var expireAt time.Time
+		if err := rows.Scan(&rs.ID, &rs.Amount, &expireAt); err != nil {
+			logf(r, "warn", "select reserves failed. err: %s", err)
+			Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if expireAt.Before(border) {
+			rs = ReserveStatus{ID: rs.ID, Status: "expired"}
 		} else {
-			log.Printf("[WARN] cancel credit failed. err: %s", err)
+			rs.Status = "active"
+			rs.ExpireAt = &expireAt
+		}
+		found[rs.ID] = rs
+	}
+	if err = rows.Err(); err != nil {
+		logf(r, "warn", "select reserves failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	reserves := make([]ReserveStatus, 0, l)
+	for _, id := range req.ReserveIDs {
+		rs, ok := found[id]
+		if !ok {
+			rs = ReserveStatus{ID: id, Status: "not_found"}
+		}
+		reserves = append(reserves, rs)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "ok",
+		"reserves": reserves,
+	})
+}
+
+// Reserves は POST /reserves を処理
+// ユーザーの有効な予約をid順で返します。使える残高が足りない理由を調べる用なのでlockはしません
+func (s *Handler) Reserves(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type ReqPram struct {
+		BankID string `json:"bank_id"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		Error(w, "can't parse body", http.StatusBadRequest)
+		return
+	}
+	userID := s.filterBankID(w, r, req.BankID)
+	if userID <= 0 {
+		return
+	}
+	type Reserve struct {
+		ID       int64     `json:"id"`
+		Amount   int64     `json:"amount"`
+		Note     string    `json:"note"`
+		IsMinus  bool      `json:"is_minus"`
+		ExpireAt time.Time `json:"expire_at"`
+	}
+	query := `SELECT id, amount, note, is_minus, expire_at FROM reserve WHERE user_id = ? AND expire_at >= ? ORDER BY id`
+	rows, err := s.readDB().QueryContext(r.Context(), query, userID, s.expiryBorder())
+	if err != nil {
+		logf(r, "warn", "select reserves failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	reserves := make([]Reserve, 0, 10)
+	for rows.Next() {
+		var rsv Reserve
+		if err := rows.Scan(&rsv.ID, &rsv.Amount, &rsv.Note, &rsv.IsMinus, &rsv.ExpireAt); err != nil {
+			logf(r, "warn", "select reserves failed. err: %s", err)
 			Error(w, "internal server error", http.StatusInternalServerError)
+			return
 		}
+		reserves = append(reserves, rsv)
+	}
+	if err = rows.Err(); err != nil {
+		logf(r, "warn", "select reserves failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-	Success(w)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "ok",
+		"reserves": reserves,
+	})
 }
 
-func (s *Handler) filterBankID(w http.ResponseWriter, bankID string) int64 {
+func (s *Handler) filterBankID(w http.ResponseWriter, r *http.Request, bankID string) int64 {
 	if bankID == "" {
 		Error(w, "bank_id is required", http.StatusBadRequest)
 		return 0
@@ -573,13 +2250,13 @@ func (s *Handler) filterBankID(w http.ResponseWriter, bankID string) int64 {
 	cacheBankIDMutex.RUnlock()
 
 	var id int64
-	err := s.db.QueryRow(`SELECT id FROM user WHERE bank_id = ? LIMIT 1`, bankID).Scan(&id)
+	err := s.db.QueryRowContext(r.Context(), `SELECT id FROM user WHERE bank_id = ? LIMIT 1`, bankID).Scan(&id)
 	switch {
 	case err == sql.ErrNoRows:
-		Error(w, "bank_id not found", http.StatusNotFound)
+		ErrorWithCode(w, "bank_id not found", "user_not_found", http.StatusNotFound)
 		return 0
 	case err != nil:
-		log.Printf("[WARN] get user failed. err: %s", err)
+		logf(r, "warn", "get user failed. err: %s", err)
 		Error(w, "internal server error", http.StatusInternalServerError)
 		return 0 // クエリ失敗の時は cache しないで返る
 	}
@@ -589,8 +2266,91 @@ func (s *Handler) filterBankID(w http.ResponseWriter, bankID string) int64 {
 	return id
 }
 
-func (s *Handler) txScope(f func(*sql.Tx) error) (err error) {
-	tx, err := s.db.Begin()
+// expiryBorder は expire_at がこの時刻以上の予約を有効とみなす境界です
+// -expiry-grace の分だけ期限を過ぎた予約も有効にして、サーバー間の時計のずれで期限の直前に commit できなくなるのを防ぎます。
+// その代わり予約が実際に有効な期間は最大で grace だけ長くなり、その間は is_minus の予約の分の残高も使えないままになります
+func (s *Handler) expiryBorder() time.Time {
+	return s.clock.Now().Add(-*expiryGrace)
+}
+
+// readDB は読み込みだけのクエリに使う DB です。replica が無ければ primary を使います
+// 書き込みの直後に読む経路(filterBankID や transaction の中)では replica の遅延があるので使わないでください
+func (s *Handler) readDB() *sql.DB {
+	if s.replica != nil {
+		return s.replica
+	}
+	return s.db
+}
+
+// txScope は transaction を開始して f を実行します
+// ctx はリクエストの context で、クライアントが切断するか -query-timeout を過ぎると query は中断されます
+// deadlock と lock wait timeout の場合は -tx-retry 回まで f をやり直します
+func (s *Handler) txScope(ctx context.Context, f func(context.Context, *queryTx) error) error {
+	start := time.Now()
+	defer func() {
+		addDBTime(ctx, time.Since(start))
+	}()
+	for attempt := 1; ; attempt++ {
+		err := s.txOnce(ctx, f)
+		if err == nil || attempt > *txRetry || !isRetryableError(err) {
+			return err
+		}
+		log.Printf("[INFO] retry transaction (attempt %d). err: %s", attempt, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
+}
+
+// parseTxIsolation は -tx-isolation を TxOptions にします。空の場合は nil で、MySQL の設定のままにします
+// reserve/commit/cancel は user の行を SELECT ... FOR UPDATE で lock してから残高と予約を読むので、
+// READ-COMMITTED にしても同じ user への変更は直列化され、残高がマイナスになることはありません
+// lock を取らない読み込みは transaction の途中で他の commit の結果が見えるようになりますが、
+// /check (exact でない場合) や /credit などの読み込みはもともと transaction を使わないので影響しません
+// READ-UNCOMMITTED は rollback される予約も見えてしまうので、確認用以外には使わないでください
+func parseTxIsolation(s string) (*sql.TxOptions, error) {
+	var level sql.IsolationLevel
+	switch strings.ToUpper(strings.Replace(s, "_", "-", -1)) {
+	case "":
+		return nil, nil
+	case "READ-UNCOMMITTED":
+		level = sql.LevelReadUncommitted
+	case "READ-COMMITTED":
+		level = sql.LevelReadCommitted
+	case "REPEATABLE-READ":
+		level = sql.LevelRepeatableRead
+	case "SERIALIZABLE":
+		level = sql.LevelSerializable
+	default:
+		return nil, errors.Errorf("unknown -tx-isolation %q", s)
+	}
+	return &sql.TxOptions{Isolation: level}, nil
+}
+
+// errCreditConflict は modifyCredit が読んだ後に他の transaction が user.credit を変更したことを表します
+var errCreditConflict = errors.New("user.credit is modified by another transaction")
+
+// isRetryableError は deadlock (1213) と lock wait timeout (1205)、errCreditConflict を判定します
+func isRetryableError(err error) bool {
+	if errors.Cause(err) == errCreditConflict {
+		return true
+	}
+	if mysqlError, ok := errors.Cause(err).(*mysql.MySQLError); ok {
+		return mysqlError.Number == 1213 || mysqlError.Number == 1205
+	}
+	return false
+}
+
+func (s *Handler) txOnce(ctx context.Context, f func(context.Context, *queryTx) error) (err error) {
+	if *queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *queryTimeout)
+		defer cancel()
+	}
+	ctx = s.audit.begin(ctx)
+	tx, err := s.db.BeginTx(ctx, s.txOpts)
 	if err != nil {
 		return errors.Wrap(err, "begin transaction failed")
 	}
@@ -600,26 +2360,246 @@ func (s *Handler) txScope(f func(*sql.Tx) error) (err error) {
 			err = errors.Errorf("panic in transaction: %s", e)
 		} else if err != nil {
 			tx.Rollback()
-		} else {
-			err = tx.Commit()
+		} else if err = tx.Commit(); err == nil {
+			// rollback された変更は記録しない
+			if e := s.audit.flush(ctx); e != nil {
+				log.Printf("[WARN] %s", e)
+			}
 		}
 	}()
-	err = f(tx)
+	err = f(ctx, &queryTx{tx})
 	return
 }
 
-func (s *Handler) modifyCredit(tx *sql.Tx, userID, price int64, memo string) error {
-	if _, err := tx.Exec(`INSERT INTO credit (user_id, amount, note, created_at) VALUES (?, ?, ?, NOW(6))`, userID, price, memo); err != nil {
-		return errors.Wrap(err, "insert credit failed")
+// useIdempotencyKey は idempotency_key を記録します
+// -idempotency-window 以内に同じuserで使われたkeyであれば CreditIsAlreadyAdded を返します
+func (s *Handler) useIdempotencyKey(ctx context.Context, tx *queryTx, userID int64, key string) error {
+	var createdAt time.Time
+	err := tx.QueryRowContext(ctx, `SELECT created_at FROM credit_idempotency WHERE user_id = ? AND idempotency_key = ? FOR UPDATE`, userID, key).Scan(&createdAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return errors.Wrap(err, "select idempotency key failed")
+	case s.clock.Now().Sub(createdAt) <= *idempotencyWindow:
+		return CreditIsAlreadyAdded
+	default:
+		// 古いkeyは無視して使い直す
+		if _, err := tx.ExecContext(ctx, `DELETE FROM credit_idempotency WHERE user_id = ? AND idempotency_key = ?`, userID, key); err != nil {
+			return errors.Wrap(err, "delete idempotency key failed")
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO credit_idempotency (user_id, idempotency_key, created_at) VALUES (?, ?, ?)`, userID, key, s.clock.Now()); err != nil {
+		return errors.Wrap(err, "insert idempotency key failed")
+	}
+	return nil
+}
+
+func (s *Handler) modifyCredit(ctx context.Context, tx *queryTx, userID, price int64, memo string) (int64, error) {
+	// user.credit は credit の集計値です。before は更新を user.credit が変わっていない時だけにするために使います
+	var before int64
+	if err := tx.QueryRowContext(ctx, `SELECT credit FROM user WHERE id = ?`, userID).Scan(&before); err != nil {
+		return 0, errors.Wrap(err, "select user.credit failed")
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO credit (user_id, amount, note, created_at) VALUES (?, ?, ?, ?)`, userID, price, memo, s.clock.Now()); err != nil {
+		return 0, errors.Wrap(err, "insert credit failed")
 	}
 	var credit int64
-	if err := tx.QueryRow(`SELECT IFNULL(SUM(amount),0) FROM credit WHERE user_id = ?`, userID).Scan(&credit); err != nil {
-		return errors.Wrap(err, "calc credit failed")
+	if err := tx.QueryRowContext(ctx, `SELECT IFNULL(SUM(amount),0) FROM credit WHERE user_id = ?`, userID).Scan(&credit); err != nil {
+		return 0, errors.Wrap(err, "calc credit failed")
 	}
-	if _, err := tx.Exec(`UPDATE user SET credit = ? WHERE id = ?`, credit, userID); err != nil {
-		return errors.Wrap(err, "update user.credit failed")
+	if before+price != credit {
+		// 以前の更新で user.credit と集計がずれている
+		log.Printf("[WARN] user.credit mismatch. user_id: %d, credit: %d, price: %d, sum: %d", userID, before, price, credit)
+	}
+	if price > 0 && *maxCredit > 0 && credit > *maxCredit {
+		return 0, CreditCapExceeded
+	}
+	// before と集計は lock しない読み込みなので、その後に他の transaction が commit していれば古い値になっている
+	// その場合は上書きせずに errCreditConflict で transaction ごとやり直す
+	res, err := tx.ExecContext(ctx, `UPDATE user SET credit = ? WHERE id = ? AND credit = ?`, credit, userID, before)
+	if err != nil {
+		return 0, errors.Wrap(err, "update user.credit failed")
+	}
+	// 値が変わらない UPDATE は affected rows が 0 になるので、変わる時だけ確認する
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, errors.Wrap(err, "update user.credit failed")
+	} else if n == 0 && credit != before {
+		return 0, errCreditConflict
+	}
+	s.audit.record(ctx, userID, price, credit, memo)
+	return credit, nil
+}
+
+// Stats は GET /stats を処理
+// ダッシュボード用に bank 全体の集計を返します。DBへの負荷を抑えるため -stats-ttl の間は cache します
+func (s *Handler) Stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if s.stats == nil || time.Since(s.statsAt) >= *statsTTL {
+		st := &bankStats{}
+		// 期限は expire_at と同じく DB ではなく Handler.clock の時刻で判定する
+		now := s.clock.Now()
+		queries := []struct {
+			query string
+			args  []interface{}
+			dest  *int64
+		}{
+			{`SELECT COUNT(id) FROM user`, nil, &st.Users},
+			{`SELECT IFNULL(SUM(credit), 0) FROM user`, nil, &st.TotalCredit},
+			{`SELECT COUNT(id) FROM reserve WHERE expire_at >= ?`, []interface{}{now}, &st.ActiveReserves},
+			{`SELECT COUNT(id) FROM reserve WHERE expire_at < ?`, []interface{}{now}, &st.ExpiredReserves},
+		}
+		for _, q := range queries {
+			if err := s.readDB().QueryRowContext(r.Context(), q.query, q.args...).Scan(q.dest); err != nil {
+				logf(r, "warn", "stats failed. err: %s", err)
+				Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		s.stats = st
+		s.statsAt = time.Now()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"stats":  s.stats,
+	})
+}
+
+// Healthz は GET /healthz を処理
+// DBに疎通できるかと connection pool の使用状況を返します
+func (s *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	stats := s.db.Stats()
+	res := map[string]interface{}{
+		"status":           "ok",
+		"open_connections": stats.OpenConnections,
+		"in_use":           stats.InUse,
+	}
+	code := http.StatusOK
+	if err := s.db.PingContext(ctx); err != nil {
+		logf(r, "warn", "healthz ping failed. err: %s", err)
+		res["status"] = "ng"
+		res["error"] = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+// Time は GET /time を処理
+// 予約の期限は銀行の時刻で判定されるので、クライアントが時刻のずれを補正できるように現在時刻を返します
+func (s *Handler) Time(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := s.clock.Now().In(time.Local)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"now":    now.Format(time.RFC3339),
+		"unix":   now.Unix(),
+	})
+}
+
+// Reset は POST /reset を処理 (-enable-reset の時のみ)
+// bench の実行前にすべてのテーブルを空にして削除したユーザー数を返します
+func (s *Handler) Reset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var users int64
+	if err := s.db.QueryRowContext(r.Context(), `SELECT COUNT(id) FROM user`).Scan(&users); err != nil {
+		logf(r, "warn", "count user failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	// TRUNCATE は暗黙的にcommitされるので transaction にはできないが、auto increment も戻る
+	queries := []string{
+		`TRUNCATE user`,
+		`TRUNCATE credit`,
+		`TRUNCATE reserve`,
+		`TRUNCATE credit_idempotency`,
+	}
+	for _, query := range queries {
+		logf(r, "info", "reset %s", query)
+		if _, err := s.db.ExecContext(r.Context(), query); err != nil {
+			logf(r, "warn", "reset failed. err: %s", err)
+			Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	// user.id が振り直されるので bank_id の cache も捨てる
+	cacheBankIDMutex.Lock()
+	cacheBankID = make(map[string]int64, 1000)
+	cacheBankIDMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        "ok",
+		"removed_users": users,
+	})
+}
+
+// Expire は POST /expire を処理
+// テスト用に予約の expire_at を過去にして、TTL を待たずに reserve_expired になる状態を作ります
+func (s *Handler) Expire(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type ReqPram struct {
+		ReserveID int64 `json:"reserve_id"`
+	}
+	req := &ReqPram{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadBody(w, err)
+		return
+	}
+	if req.ReserveID <= 0 {
+		Error(w, "reserve_id is required", http.StatusBadRequest)
+		return
+	}
+	// -expiry-grace の猶予も過ぎた時刻にする
+	expire := s.expiryBorder().Add(-time.Second)
+	var found bool
+	err := s.txScope(r.Context(), func(ctx context.Context, tx *queryTx) error {
+		var id int64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM reserve WHERE id = ? FOR UPDATE`, req.ReserveID).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "select reserve failed")
+		}
+		found = true
+		if _, err := tx.ExecContext(ctx, `UPDATE reserve SET expire_at = ? WHERE id = ?`, expire, req.ReserveID); err != nil {
+			return errors.Wrap(err, "update reserve failed")
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		logf(r, "warn", "expire reserve failed. err: %s", err)
+		Error(w, "internal server error", http.StatusInternalServerError)
+	case !found:
+		ErrorWithCode(w, "reserve not found", "reserve_not_found", http.StatusNotFound)
+	default:
+		logf(r, "info", "expire reserve_id: %d", req.ReserveID)
+		Success(w)
 	}
-	return nil
 }
 
 func (s *Handler) Initialize(w http.ResponseWriter, r *http.Request) {
@@ -631,10 +2611,11 @@ func (s *Handler) Initialize(w http.ResponseWriter, r *http.Request) {
 		`TRUNCATE user`,
 		`TRUNCATE credit`,
 		`TRUNCATE reserve`,
+		`TRUNCATE credit_idempotency`,
 	}
 	for _, query := range queries {
-		log.Println("initialize", query)
-		if _, err := s.db.Exec(query); err != nil {
+		logf(r, "info", "initialize %s", query)
+		if _, err := s.db.ExecContext(r.Context(), query); err != nil {
 			Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -642,11 +2623,20 @@ func (s *Handler) Initialize(w http.ResponseWriter, r *http.Request) {
 	Success(w)
 }
 
+// init は今まで通り time.Local を LocationName にします。main では -tz で変更できます
+// tzdata が無い環境でも import で panic しないように、読めなければそのままにします
 func init() {
-	var err error
-	loc, err := time.LoadLocation(LocationName)
+	if err := setLocation(LocationName); err != nil {
+		log.Printf("[WARN] %s", err)
+	}
+}
+
+// setLocation は time.Local を name (Asia/Tokyo や UTC など) にします
+func setLocation(name string) error {
+	loc, err := time.LoadLocation(name)
 	if err != nil {
-		log.Panicln(err)
+		return errors.Wrapf(err, "load location %s failed", name)
 	}
 	time.Local = loc
+	return nil
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics は /metrics で公開する Prometheus の指標です
+// -enable-metrics が指定されていない場合は nil で、その場合はすべて何もしません
+type metrics struct {
+	registry        *prometheus.Registry
+	requestCount    *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	batchSize       *prometheus.HistogramVec
+	rejections      *prometheus.CounterVec
+}
+
+func newMetrics(db *sql.DB, clock Clock) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requestCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "isubank_http_requests_total",
+			Help: "Number of HTTP requests by endpoint and status code.",
+		}, []string{"endpoint", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "isubank_http_request_duration_seconds",
+			Help:    "HTTP request latency by endpoint and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint", "code"}),
+		batchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "isubank_batch_size",
+			Help:    "Number of reserve_ids in a /commit or /cancel request.",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		}, []string{"endpoint"}),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "isubank_business_rejections_total",
+			Help: "Number of requests rejected by business rules (e.g. credit_insufficient, reserve_expired) by endpoint and error code.",
+		}, []string{"endpoint", "code"}),
+	}
+	m.registry.MustRegister(
+		m.requestCount,
+		m.requestDuration,
+		m.batchSize,
+		m.rejections,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "isubank_db_open_connections",
+			Help: "Number of established connections to the database.",
+		}, func() float64 {
+			return float64(db.Stats().OpenConnections)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "isubank_db_in_use_connections",
+			Help: "Number of database connections currently in use.",
+		}, func() float64 {
+			return float64(db.Stats().InUse)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "isubank_active_reserves",
+			Help: "Number of reserves which are not expired yet.",
+		}, func() float64 {
+			var count int64
+			if err := db.QueryRow(`SELECT COUNT(id) FROM reserve WHERE expire_at >= ?`, clock.Now()).Scan(&count); err != nil {
+				log.Printf("[WARN] count active reserves failed. err: %s", err)
+				return 0
+			}
+			return float64(count)
+		}),
+	)
+	return m
+}
+
+// observeConcurrency は l の実行中のリクエスト数を endpoint ごとの gauge として公開します
+func (m *metrics) observeConcurrency(endpoint string, l *concurrencyLimiter) {
+	if m == nil || l == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "isubank_concurrent_requests",
+		Help:        "Number of in-flight requests of endpoints limited by -max-concurrent-*.",
+		ConstLabels: prometheus.Labels{"endpoint": endpoint},
+	}, func() float64 {
+		return float64(l.Inflight())
+	}))
+}
+
+// observeBatch は1リクエストの reserve_ids の数を記録します
+func (m *metrics) observeBatch(endpoint string, n int) {
+	if m == nil {
+		return
+	}
+	m.batchSize.WithLabelValues(endpoint).Observe(float64(n))
+}
+
+// observeBatch は /commit, /cancel の reserve_ids の数を記録し、-warn-batch-size を超えていれば警告します
+// 一度に多くのユーザーの lock を取るので、まとめすぎている client を見つけるためです
+func (s *Handler) observeBatch(r *http.Request, endpoint string, n int) {
+	s.metrics.observeBatch(endpoint, n)
+	if *warnBatchSize > 0 && n > *warnBatchSize {
+		appid, _ := appID(r)
+		logf(r, "warn", "large batch of %s. reserve_ids: %d, app_id: %s", endpoint, n, appid)
+	}
+}
+
+// observeRejection は業務エラーで断ったリクエストを errorCodes のコードごとに数えます
+// 想定内のエラーなのでログには出していないため、頻度はこれで確認します
+func (m *metrics) observeRejection(endpoint string, err error) {
+	if m == nil {
+		return
+	}
+	code, ok := errorCodes[err]
+	if !ok {
+		code = "error"
+	}
+	m.rejections.WithLabelValues(endpoint, code).Inc()
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument はリクエスト数とレイテンシを endpoint, status code ごとに記録します
+func (m *metrics) instrument(endpoint string, f http.HandlerFunc) http.HandlerFunc {
+	if m == nil {
+		return f
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		f.ServeHTTP(sw, r)
+		code := strconv.Itoa(sw.status)
+		m.requestCount.WithLabelValues(endpoint, code).Inc()
+		m.requestDuration.WithLabelValues(endpoint, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
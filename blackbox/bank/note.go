@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"text/template"
+	"time"
+)
+
+// ReserveNoteMaxLen は reserve.note と credit.note の VARCHAR(255) の文字数です
+const ReserveNoteMaxLen = 255
+
+// reserveNote は -reserve-note-format に渡す値です
+// 予約の note は commit された時に残高の変動履歴の memo にもなります
+// Now は monotonic clock を含まないので、そのまま出力しても "m=+..." は付きません
+type reserveNote struct {
+	AppID  string
+	Price  int64
+	BankID string
+	Now    time.Time
+}
+
+// parseReserveNote は -reserve-note-format を読み、試しに実行して確認します
+// 空の場合や不正な場合は nil を返し、今まで通りの "app:%s, price:%d" を使います
+func parseReserveNote(format string) *template.Template {
+	if format == "" {
+		return nil
+	}
+	t, err := template.New("note").Option("missingkey=error").Parse(format)
+	if err == nil {
+		err = t.Execute(&bytes.Buffer{}, reserveNote{AppID: "app", Price: 1, BankID: "bank", Now: time.Now()})
+	}
+	if err != nil {
+		log.Printf("[WARN] invalid -reserve-note-format, use default. err: %s", err)
+		return nil
+	}
+	return t
+}
+
+// reserveNote は予約の note を作ります
+// 長い bank_id などで ReserveNoteMaxLen を超えると insert できなくなるので切り詰めます
+func (s *Handler) reserveNote(appid, bankID string, price int64) string {
+	if s.note != nil {
+		b := &bytes.Buffer{}
+		err := s.note.Execute(b, reserveNote{AppID: appid, Price: price, BankID: bankID, Now: s.clock.Now().Round(0)})
+		if err == nil {
+			if note := []rune(b.String()); len(note) > ReserveNoteMaxLen {
+				return string(note[:ReserveNoteMaxLen])
+			}
+			return b.String()
+		}
+		log.Printf("[WARN] execute -reserve-note-format failed. err: %s", err)
+	}
+	return fmt.Sprintf("app:%s, price:%d", appid, price)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Price はリクエストの price です
+// 数値の場合は今まで通り最小単位の整数として、文字列の場合は -minor-units 桁の小数として読み、最小単位の整数にします
+type Price int64
+
+// PriceError は文字列の price が読めない場合のエラーです
+type PriceError struct {
+	Value  string
+	Reason string
+}
+
+func (e *PriceError) Error() string {
+	return fmt.Sprintf("invalid price %q: %s", e.Value, e.Reason)
+}
+
+func (p *Price) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		v, err := parsePrice(s, *minorUnits)
+		if err != nil {
+			return err
+		}
+		*p = Price(v)
+		return nil
+	}
+	var v int64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = Price(v)
+	return nil
+}
+
+// parsePrice は "-12.34" のような10進数の文字列を scale 桁の固定小数点の整数にします
+// scale より細かい桁を持つものは丸めずにエラーにします。int64 に収まらないものは -max-price で弾かれるように上限の値にします
+func parsePrice(s string, scale int) (int64, error) {
+	str := s
+	sign := ""
+	if strings.HasPrefix(str, "-") || strings.HasPrefix(str, "+") {
+		sign, str = str[:1], str[1:]
+	}
+	intPart, frac := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		intPart, frac = str[:i], str[i+1:]
+	}
+	if intPart == "" && frac == "" || !isDigits(intPart) || !isDigits(frac) {
+		return 0, &PriceError{s, "not a decimal number"}
+	}
+	// 末尾の0は精度に含めない
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > scale {
+		return 0, &PriceError{s, fmt.Sprintf("too much precision (minor units: %d)", scale)}
+	}
+	digits := intPart + frac + strings.Repeat("0", scale-len(frac))
+	v, err := strconv.ParseInt(sign+digits, 10, 64)
+	if err != nil {
+		if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+			return v, nil
+		}
+		return 0, &PriceError{s, "not a decimal number"}
+	}
+	return v, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimitSweepInterval は使われなくなった bucket を消す間隔です
+const RateLimitSweepInterval = time.Minute
+
+// rateLimiter は app_id ごとの token bucket です
+// app_id は client が自由に付けられるので、使われなくなった bucket は RateLimitSweepInterval ごとに消します
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket, 100),
+		swept:   time.Now(),
+	}
+}
+
+// sweep は burst まで回復しきった bucket を消します
+// 回復しきった bucket は新しく作るものと同じなので、消しても制限は変わりません
+func (l *rateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) >= RateLimitSweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimitHandler は app_id ごとに -rate-limit を超えたリクエストを 429 で拒否します
+// app_id は Authorization header から、なければ JSON body の app_id から取得します
+// app_id が無いリクエストは制限しません
+func rateLimitHandler(l *rateLimiter, f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appid, err := appID(r)
+		if err != nil {
+			appid = bodyAppID(r)
+		}
+		if appid != "" && !l.allow(appid) {
+			ErrorWithCode(w, "too many requests", "rate_limited", http.StatusTooManyRequests)
+			return
+		}
+		f.ServeHTTP(w, r)
+	})
+}
+
+// bodyAppID は body の app_id を読み取り、後続の handler のために body を戻します
+func bodyAppID(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return ""
+	}
+	var v struct {
+		AppID string `json:"app_id"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return ""
+	}
+	return v.AppID
+}
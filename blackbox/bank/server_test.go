@@ -0,0 +1,807 @@
+package main_test
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	main "github.com/ken39arg/isucon2018-final/blackbox/bank"
+)
+
+type Spec struct {
+	Title       string
+	Method      string
+	Path        string
+	AppID       string
+	RequestBody []byte
+
+	StatusCode int
+	ErrorCode  string
+}
+
+func (s Spec) Run(t *testing.T, base string) ([]byte, error) {
+	req, err := newRequest(base, s)
+	if err != nil {
+		t.Fatalf("new request failed: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != s.StatusCode {
+		t.Errorf("unexpected status of %s: got:%d expected:%d", s.Title, resp.StatusCode, s.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if s.ErrorCode != "" {
+		var res struct {
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Errorf("unexpected body of %s: %s", s.Title, b)
+		} else if res.Code != s.ErrorCode {
+			t.Errorf("unexpected code of %s: got:%s expected:%s", s.Title, res.Code, s.ErrorCode)
+		}
+	}
+	return b, nil
+}
+
+func newRequest(base string, s Spec) (*http.Request, error) {
+	req, err := http.NewRequest(s.Method, base+s.Path, bytes.NewReader(s.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+	if s.AppID != "" {
+		req.Header.Add("Authorization", "Bearer "+s.AppID)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	return req, nil
+}
+
+// DBを使わずに済むように bank_id は空にしています
+// price の検証を通過したものは bank_id の検証で bad_request になります
+var priceSpecs = []Spec{
+	Spec{
+		"/add_credit max price",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"","price":1000000000000000}`),
+		400, "bad_request",
+	},
+	Spec{
+		"/add_credit over max price",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"","price":1000000000000001}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/add_credit max int64",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"","price":9223372036854775807}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/check max price",
+		"POST", "/check", "AAA", []byte(`{"bank_id":"","price":1000000000000000}`),
+		400, "bad_request",
+	},
+	Spec{
+		"/check over max price",
+		"POST", "/check", "AAA", []byte(`{"bank_id":"","price":1000000000000001}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/reserve max price",
+		"POST", "/reserve", "AAA", []byte(`{"bank_id":"","price":1000000000000000}`),
+		400, "bad_request",
+	},
+	Spec{
+		"/reserve over max price",
+		"POST", "/reserve", "AAA", []byte(`{"bank_id":"","price":1000000000000001}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/reserve min price",
+		"POST", "/reserve", "AAA", []byte(`{"bank_id":"","price":-1000000000000000}`),
+		400, "bad_request",
+	},
+	Spec{
+		"/reserve under min price",
+		"POST", "/reserve", "AAA", []byte(`{"bank_id":"","price":-1000000000000001}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/reserve min int64",
+		"POST", "/reserve", "AAA", []byte(`{"bank_id":"","price":-9223372036854775808}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/charge max price",
+		"POST", "/charge", "AAA", []byte(`{"bank_id":"","price":-1000000000000000}`),
+		400, "bad_request",
+	},
+	Spec{
+		"/charge under min price",
+		"POST", "/charge", "AAA", []byte(`{"bank_id":"","price":-1000000000000001}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/charge app_id in body",
+		"POST", "/charge", "", []byte(`{"app_id":"AAA","bank_id":"","price":-1000000000000000}`),
+		400, "bad_request",
+	},
+	Spec{
+		"/charge without app_id",
+		"POST", "/charge", "", []byte(`{"bank_id":"","price":-1000000000000000}`),
+		403, "",
+	},
+	Spec{
+		"/add_credit string price",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"","price":"100"}`),
+		400, "bad_request",
+	},
+	Spec{
+		"/add_credit string price over max price",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"","price":"1000000000000001"}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/add_credit string price overflow",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"","price":"99999999999999999999"}`),
+		400, "price_too_large",
+	},
+	Spec{
+		"/add_credit string price too much precision",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"","price":"100.5"}`),
+		400, "invalid_price",
+	},
+	Spec{
+		"/reserve string price not a number",
+		"POST", "/reserve", "AAA", []byte(`{"bank_id":"","price":"1e3"}`),
+		400, "invalid_price",
+	},
+	Spec{
+		"/reserve_multi over max price",
+		"POST", "/reserve_multi", "AAA", []byte(`{"reserves":[{"bank_id":"","price":1000000000000001}]}`),
+		400, "price_too_large",
+	},
+}
+
+func reserveIDsBody(n int) []byte {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i + 1)
+	}
+	return []byte(`{"reserve_ids":[` + strings.Join(ids, ",") + `]}`)
+}
+
+var limitSpecs = []Spec{
+	Spec{
+		"/add_credit too large body",
+		"POST", "/add_credit", "", []byte(`{"bank_id":"` + strings.Repeat("x", 1<<20) + `","price":1}`),
+		413, "request_too_large",
+	},
+	Spec{
+		"/commit too many reserve_ids",
+		"POST", "/commit", "AAA", reserveIDsBody(1001),
+		413, "too_many_reserve_ids",
+	},
+	Spec{
+		"/cancel too many reserve_ids",
+		"POST", "/cancel", "AAA", reserveIDsBody(1001),
+		413, "too_many_reserve_ids",
+	},
+}
+
+var ts = httptest.NewServer(main.NewServer(nil))
+
+func TestPrice(t *testing.T) {
+	for _, spec := range priceSpecs {
+		spec.Run(t, ts.URL)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	for _, spec := range limitSpecs {
+		spec.Run(t, ts.URL)
+	}
+}
+
+// faultCounts は -fail-rate を指定した server に n 回 /commit した結果です
+// reserve_ids が空なので DB を使わずに、注入されなければ 400 になります
+type faultCounts struct {
+	Pass, Fail, Slow int
+}
+
+func commitWithFault(t *testing.T, n int, delay time.Duration) faultCounts {
+	s := httptest.NewServer(main.NewServer(nil))
+	defer s.Close()
+	spec := Spec{"/commit fault", "POST", "/commit", "AAA", []byte(`{"reserve_ids":[]}`), 0, ""}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	counts := faultCounts{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := newRequest(s.URL, spec)
+			if err != nil {
+				t.Errorf("new request failed: %s", err)
+				return
+			}
+			start := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("do request failed: %s", err)
+				return
+			}
+			resp.Body.Close()
+			elapsed := time.Since(start)
+			mu.Lock()
+			defer mu.Unlock()
+			switch resp.StatusCode {
+			case 400:
+				counts.Pass++
+			case 500:
+				counts.Fail++
+				if elapsed >= delay {
+					counts.Slow++
+				}
+			default:
+				t.Errorf("unexpected status: %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	return counts
+}
+
+func TestFaultInjection(t *testing.T) {
+	const n = 20
+	delay := 100 * time.Millisecond
+
+	// -fail-rate が 0 なら素通しする
+	if c := commitWithFault(t, n, delay); c.Pass != n {
+		t.Errorf("unexpected result without -fail-rate: %+v", c)
+	}
+
+	flag.Set("fail-rate", "0.5")
+	flag.Set("fail-seed", "1")
+	flag.Set("fail-delay", delay.String())
+	defer func() {
+		flag.Set("fail-rate", "0")
+		flag.Set("fail-seed", "1")
+		flag.Set("fail-delay", "10s")
+	}()
+	c := commitWithFault(t, n, delay)
+	if c.Pass == 0 || c.Fail == 0 || c.Pass+c.Fail != n {
+		t.Errorf("expected both injected and passed requests: %+v", c)
+	}
+	if c.Slow == 0 || c.Slow == c.Fail {
+		t.Errorf("expected both delayed and immediate failures: %+v", c)
+	}
+	// 同じ seed なら同じ数だけ失敗する
+	if c2 := commitWithFault(t, n, delay); c2 != c {
+		t.Errorf("unexpected result with the same seed: got:%+v expected:%+v", c2, c)
+	}
+
+	flag.Set("fail-rate", "1")
+	if c := commitWithFault(t, n, delay); c.Fail != n {
+		t.Errorf("unexpected result with -fail-rate 1: %+v", c)
+	}
+}
+
+func TestTime(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2018, 10, 20, 10, 0, 0, 0, time.UTC)}
+	s := httptest.NewServer(main.NewServerWithClock(nil, clock))
+	defer s.Close()
+	spec := Spec{
+		Title:      "/time",
+		Method:     "GET",
+		Path:       "/time",
+		StatusCode: 200,
+	}
+	b, err := spec.Run(t, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Now  string `json:"now"`
+		Unix int64  `json:"unix"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("unexpected body: %s", b)
+	}
+	if res.Now != "2018-10-20T19:00:00+09:00" {
+		t.Errorf("unexpected now: got:%s expected:2018-10-20T19:00:00+09:00", res.Now)
+	}
+	if res.Unix != clock.now.Unix() {
+		t.Errorf("unexpected unix: got:%d expected:%d", res.Unix, clock.now.Unix())
+	}
+}
+
+// testDB は ISUBANK_TEST_DSN で指定された MySQL に接続します
+// 指定がなければDBを使うテストは skip します
+func testDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("ISUBANK_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ISUBANK_TEST_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("mysql connect failed. err: %s", err)
+	}
+	return db
+}
+
+func postJSON(t *testing.T, base, path, appID string, v interface{}) (int, []byte) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	req, err := http.NewRequest("POST", base+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request failed: %s", err)
+	}
+	if appID != "" {
+		req.Header.Add("Authorization", "Bearer "+appID)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body failed: %s", err)
+	}
+	return resp.StatusCode, b
+}
+
+// registerUser は prefix に時刻を付けた bank_id を登録し、credit が 0 より大きければ入金して bank_id を返します
+func registerUser(t *testing.T, base, prefix string, credit int64) string {
+	bankID := fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+	if code, b := postJSON(t, base, "/register", "", map[string]interface{}{"bank_id": bankID}); code != 200 {
+		t.Fatalf("register failed: %d %s", code, b)
+	}
+	if credit > 0 {
+		if code, b := postJSON(t, base, "/add_credit", "", map[string]interface{}{"bank_id": bankID, "price": credit}); code != 200 {
+			t.Fatalf("add_credit failed: %d %s", code, b)
+		}
+	}
+	return bankID
+}
+
+// reserve は app_id AAA で予約して reserve_id を返します
+func reserve(t *testing.T, base, bankID string, price int64) int64 {
+	code, b := postJSON(t, base, "/reserve", "AAA", map[string]interface{}{"bank_id": bankID, "price": price})
+	if code != 200 {
+		t.Fatalf("reserve failed: %d %s", code, b)
+	}
+	var res struct {
+		ReserveID int64 `json:"reserve_id"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("unexpected reserve body: %s", b)
+	}
+	return res.ReserveID
+}
+
+func TestCreditConsistency(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	const (
+		initial  = 1000
+		workers  = 20
+		addPrice = 100
+		usePrice = 50
+	)
+	bankID := registerUser(t, s.URL, "consistency", initial)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if code, b := postJSON(t, s.URL, "/add_credit", "", map[string]interface{}{"bank_id": bankID, "price": addPrice}); code != 200 {
+				t.Errorf("add_credit failed: %d %s", code, b)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			code, b := postJSON(t, s.URL, "/reserve", "AAA", map[string]interface{}{"bank_id": bankID, "price": -usePrice})
+			if code != 200 {
+				t.Errorf("reserve failed: %d %s", code, b)
+				return
+			}
+			var res struct {
+				ReserveID int64 `json:"reserve_id"`
+			}
+			if err := json.Unmarshal(b, &res); err != nil {
+				t.Errorf("unexpected reserve body: %s", b)
+				return
+			}
+			if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{res.ReserveID}}); code != 200 {
+				t.Errorf("commit failed: %d %s", code, b)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var credit, sum int64
+	if err := db.QueryRow(`SELECT credit FROM user WHERE bank_id = ?`, bankID).Scan(&credit); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT IFNULL(SUM(c.amount),0) FROM credit c JOIN user u ON c.user_id = u.id WHERE u.bank_id = ?`, bankID).Scan(&sum); err != nil {
+		t.Fatal(err)
+	}
+	if credit != sum {
+		t.Errorf("user.credit is drifted: credit:%d sum:%d", credit, sum)
+	}
+	if expected := int64(initial + workers*(addPrice-usePrice)); credit != expected {
+		t.Errorf("unexpected credit: got:%d expected:%d", credit, expected)
+	}
+}
+
+// 2人の予約を逆順の batch で同時に commit しても、どちらの user.credit もずれない
+func TestCreditConsistencyBatch(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	const (
+		initial  = 1000
+		workers  = 20
+		addPrice = 100
+		usePrice = 50
+	)
+	users := []string{
+		registerUser(t, s.URL, "consistency-batch-a", initial),
+		registerUser(t, s.URL, "consistency-batch-b", initial),
+	}
+	batches := make([][]int64, workers)
+	for i := range batches {
+		a, b := reserve(t, s.URL, users[0], -usePrice), reserve(t, s.URL, users[1], -usePrice)
+		if i%2 == 0 {
+			batches[i] = []int64{a, b}
+		} else {
+			batches[i] = []int64{b, a}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, ids := range batches {
+		wg.Add(2)
+		go func(ids []int64) {
+			defer wg.Done()
+			if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": ids}); code != 200 {
+				t.Errorf("commit failed: %d %s", code, b)
+			}
+		}(ids)
+		go func() {
+			defer wg.Done()
+			for _, bankID := range users {
+				if code, b := postJSON(t, s.URL, "/add_credit", "", map[string]interface{}{"bank_id": bankID, "price": addPrice}); code != 200 {
+					t.Errorf("add_credit failed: %d %s", code, b)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, bankID := range users {
+		var credit, sum int64
+		if err := db.QueryRow(`SELECT credit FROM user WHERE bank_id = ?`, bankID).Scan(&credit); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow(`SELECT IFNULL(SUM(c.amount),0) FROM credit c JOIN user u ON c.user_id = u.id WHERE u.bank_id = ?`, bankID).Scan(&sum); err != nil {
+			t.Fatal(err)
+		}
+		if credit != sum {
+			t.Errorf("user.credit of %s is drifted: credit:%d sum:%d", bankID, credit, sum)
+		}
+		if expected := int64(initial + workers*(addPrice-usePrice)); credit != expected {
+			t.Errorf("unexpected credit of %s: got:%d expected:%d", bankID, credit, expected)
+		}
+	}
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestReserveExpiry(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	// DATETIME の精度に合わせて秒で切り捨てておく
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	s := httptest.NewServer(main.NewServerWithClock(db, clock))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "expiry", 1000)
+
+	// 期限ちょうどはまだ有効
+	rid := reserve(t, s.URL, bankID, -100)
+	clock.Advance(5 * time.Minute)
+	if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}}); code != 200 {
+		t.Errorf("commit at expire_at failed: %d %s", code, b)
+	}
+
+	// 期限を過ぎたら reserve_expired
+	rid = reserve(t, s.URL, bankID, -100)
+	clock.Advance(5*time.Minute + time.Second)
+	code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}})
+	if code != 400 {
+		t.Errorf("unexpected status of expired commit: got:%d expected:400 body:%s", code, b)
+	}
+	var res struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(b, &res)
+	if res.Code != "reserve_expired" {
+		t.Errorf("unexpected code of expired commit: got:%s expected:reserve_expired", res.Code)
+	}
+}
+
+func TestCancelIdempotent(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "cancel", 0)
+	rid := reserve(t, s.URL, bankID, 100)
+	cancel := func(idempotent bool) (int, int) {
+		code, b := postJSON(t, s.URL, "/cancel", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}, "idempotent": idempotent})
+		var r struct {
+			Cancelled int `json:"cancelled"`
+		}
+		json.Unmarshal(b, &r)
+		return code, r.Cancelled
+	}
+
+	if code, n := cancel(true); code != 200 || n != 1 {
+		t.Errorf("unexpected first cancel: got:%d cancelled:%d expected:200 cancelled:1", code, n)
+	}
+	// 2回目は strict なら失敗、idempotent なら成功
+	if code, _ := cancel(false); code != 409 {
+		t.Errorf("unexpected status of strict double cancel: got:%d expected:409", code)
+	}
+	if code, n := cancel(true); code != 200 || n != 0 {
+		t.Errorf("unexpected idempotent double cancel: got:%d cancelled:%d expected:200 cancelled:0", code, n)
+	}
+}
+
+func TestReserves(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "reserves", 1000)
+	for _, price := range []int64{-300, 200} {
+		reserve(t, s.URL, bankID, price)
+	}
+	code, b := postJSON(t, s.URL, "/reserves", "", map[string]interface{}{"bank_id": bankID})
+	if code != 200 {
+		t.Fatalf("reserves failed: %d %s", code, b)
+	}
+	var res struct {
+		Reserves []struct {
+			ID      int64 `json:"id"`
+			Amount  int64 `json:"amount"`
+			IsMinus bool  `json:"is_minus"`
+		} `json:"reserves"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("unexpected reserves body: %s", b)
+	}
+	if len(res.Reserves) != 2 {
+		t.Fatalf("unexpected number of reserves: got:%d expected:2 body:%s", len(res.Reserves), b)
+	}
+	if r := res.Reserves[0]; r.Amount != -300 || !r.IsMinus {
+		t.Errorf("unexpected first reserve: %+v", r)
+	}
+	if r := res.Reserves[1]; r.Amount != 200 || r.IsMinus || r.ID <= res.Reserves[0].ID {
+		t.Errorf("unexpected second reserve: %+v", r)
+	}
+}
+
+func TestReserveUpdate(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "update", 1000)
+	rid := reserve(t, s.URL, bankID, -800)
+
+	// 変更前の予約で確保している 800 は新しい金額に使える
+	if code, b := postJSON(t, s.URL, "/reserve_update", "AAA", map[string]interface{}{"reserve_id": rid, "price": -1000}); code != 200 {
+		t.Errorf("unexpected status of update within credit: got:%d expected:200 body:%s", code, b)
+	}
+	if code, b := postJSON(t, s.URL, "/reserve_update", "AAA", map[string]interface{}{"reserve_id": rid, "price": -1001}); code != 400 {
+		t.Errorf("unexpected status of update over credit: got:%d expected:400 body:%s", code, b)
+	}
+	// 他の app の予約は変更できない
+	if code, b := postJSON(t, s.URL, "/reserve_update", "BBB", map[string]interface{}{"reserve_id": rid, "price": -100}); code != 409 {
+		t.Errorf("unexpected status of update by other app: got:%d expected:409 body:%s", code, b)
+	}
+	if code, b := postJSON(t, s.URL, "/reserve_update", "AAA", map[string]interface{}{"reserve_id": rid, "price": -300}); code != 200 {
+		t.Fatalf("update failed: %d %s", code, b)
+	}
+	if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}}); code != 200 {
+		t.Fatalf("commit failed: %d %s", code, b)
+	}
+	var credit int64
+	if err := db.QueryRow(`SELECT credit FROM user WHERE bank_id = ?`, bankID).Scan(&credit); err != nil {
+		t.Fatal(err)
+	}
+	if credit != 700 {
+		t.Errorf("unexpected credit: got:%d expected:700", credit)
+	}
+	// commit 済みの予約は変更できない
+	if code, b := postJSON(t, s.URL, "/reserve_update", "AAA", map[string]interface{}{"reserve_id": rid, "price": -100}); code != 409 || !strings.Contains(string(b), "reserve_already_committed") {
+		t.Errorf("unexpected status of update after commit: got:%d expected:409 reserve_already_committed body:%s", code, b)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	flag.Set("enable-expire", "true")
+	defer flag.Set("enable-expire", "false")
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "expire", 0)
+	rid := reserve(t, s.URL, bankID, 100)
+	if code, b := postJSON(t, s.URL, "/expire", "AAA", map[string]interface{}{"reserve_id": rid}); code != 200 {
+		t.Fatalf("expire failed: %d %s", code, b)
+	}
+	code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{rid}})
+	if code != 400 || !strings.Contains(string(b), "reserve_expired") {
+		t.Errorf("unexpected commit of expired reserve: got:%d %s expected:400 reserve_expired", code, b)
+	}
+	if code, b := postJSON(t, s.URL, "/expire", "AAA", map[string]interface{}{"reserve_id": rid + 1000000}); code != 404 {
+		t.Errorf("unexpected status of unknown reserve: got:%d expected:404 body:%s", code, b)
+	}
+}
+
+func TestCommitCheck(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "commitcheck", 0)
+	valid, expired := reserve(t, s.URL, bankID, 100), reserve(t, s.URL, bankID, 100)
+	if _, err := db.Exec(`UPDATE reserve SET expire_at = ? WHERE id = ?`, time.Now().Add(-time.Hour), expired); err != nil {
+		t.Fatal(err)
+	}
+	missing := expired + 1000000
+
+	ids := []int64{valid, expired, missing}
+	code, b := postJSON(t, s.URL, "/commit_check", "AAA", map[string]interface{}{"reserve_ids": ids})
+	if code != 200 {
+		t.Fatalf("commit_check failed: %d %s", code, b)
+	}
+	var res struct {
+		Committable bool    `json:"committable"`
+		Valid       []int64 `json:"valid"`
+		Expired     []int64 `json:"expired"`
+		Missing     []int64 `json:"missing"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("unexpected commit_check body: %s", b)
+	}
+	if res.Committable || fmt.Sprint(res.Valid) != fmt.Sprint([]int64{valid}) || fmt.Sprint(res.Expired) != fmt.Sprint([]int64{expired}) || fmt.Sprint(res.Missing) != fmt.Sprint([]int64{missing}) {
+		t.Errorf("unexpected commit_check result: %s", b)
+	}
+	// 確認しただけなので予約は残っている
+	if code, b := postJSON(t, s.URL, "/commit", "AAA", map[string]interface{}{"reserve_ids": []int64{valid}}); code != 200 {
+		t.Errorf("commit after commit_check failed: %d %s", code, b)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	from := registerUser(t, s.URL, "transfer-from", 100)
+	to := registerUser(t, s.URL, "transfer-to", 0)
+	transfer := func(from, to string, price int64) (int, []byte) {
+		return postJSON(t, s.URL, "/transfer", "AAA", map[string]interface{}{"from_bank_id": from, "to_bank_id": to, "price": price})
+	}
+	if code, b := transfer(from, to, 30); code != 200 {
+		t.Fatalf("transfer failed: %d %s", code, b)
+	}
+	if code, b := transfer(from, to, 71); code != 400 || !strings.Contains(string(b), "insufficient_credit") {
+		t.Errorf("unexpected status of insufficient transfer: got:%d expected:400 body:%s", code, b)
+	}
+	if code, b := transfer(from, from, 1); code != 400 {
+		t.Errorf("unexpected status of self transfer: got:%d expected:400 body:%s", code, b)
+	}
+	if code, b := transfer(from, to, 0); code != 400 {
+		t.Errorf("unexpected status of zero transfer: got:%d expected:400 body:%s", code, b)
+	}
+	check := func(bankID string, price int64) int {
+		code, _ := postJSON(t, s.URL, "/check", "AAA", map[string]interface{}{"bank_id": bankID, "price": price})
+		return code
+	}
+	if check(from, 70) != 200 || check(from, 71) != 400 {
+		t.Errorf("unexpected credit of sender")
+	}
+	if check(to, 30) != 200 || check(to, 31) != 400 {
+		t.Errorf("unexpected credit of receiver")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	flag.Set("enable-gzip", "true")
+	defer flag.Set("enable-gzip", "false")
+	s := httptest.NewServer(main.NewServer(db))
+	defer s.Close()
+
+	bankID := registerUser(t, s.URL, "gzip", 0)
+	history := func(limit int) *http.Response {
+		body, _ := json.Marshal(map[string]interface{}{"bank_id": bankID, "limit": limit})
+		req, err := http.NewRequest("POST", s.URL+"/credit_history", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", "gzip")
+		// 自動で展開されないように自分で Accept-Encoding を付ける
+		resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := history(1); resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("small response should not be compressed: %s", resp.Header.Get("Content-Encoding"))
+	}
+	for i := 0; i < 30; i++ {
+		if code, b := postJSON(t, s.URL, "/add_credit", "", map[string]interface{}{"bank_id": bankID, "price": 100}); code != 200 {
+			t.Fatalf("add_credit failed: %d %s", code, b)
+		}
+	}
+	if resp := history(100); resp.StatusCode != 200 || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("unexpected response of large history: status:%d Content-Encoding:%q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serverTiming は1リクエストの中で txScope にかかった時間の合計です
+type serverTiming struct {
+	db int64 // time.Duration
+}
+
+func addDBTime(ctx context.Context, d time.Duration) {
+	if st, ok := ctx.Value(ServerTimingCtxKey).(*serverTiming); ok {
+		atomic.AddInt64(&st.db, int64(d))
+	}
+}
+
+// serverTimingHandler はレスポンスに Server-Timing: db;dur=12.3, total;dur=15.0 を付けます
+// header は書き出す前に付ける必要があるので、total はレスポンスを書き始めるまでの時間です
+func serverTimingHandler(f http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &serverTiming{}
+		tw := &timingWriter{ResponseWriter: w, start: time.Now(), timing: st}
+		f.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), ServerTimingCtxKey, st)))
+	})
+}
+
+type timingWriter struct {
+	http.ResponseWriter
+	start  time.Time
+	timing *serverTiming
+	wrote  bool
+}
+
+func (w *timingWriter) setHeader() {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	db := time.Duration(atomic.LoadInt64(&w.timing.db))
+	w.Header().Set("Server-Timing", fmt.Sprintf("db;dur=%.1f, total;dur=%.1f", ms(db), ms(time.Since(w.start))))
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	w.setHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
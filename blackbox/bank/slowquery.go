@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// queryTx は -slow-query を超えたクエリをログに出す *sql.Tx です
+// 負荷の高い時にどの FOR UPDATE が詰まっているのかを見つけるためのものです
+type queryTx struct {
+	*sql.Tx
+}
+
+func logSlowQuery(start time.Time, query string) {
+	if *slowQuery <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed >= *slowQuery {
+		log.Printf("[WARN] slow query. elapsed: %s, query: %s", elapsed, strings.Join(strings.Fields(query), " "))
+	}
+}
+
+func (tx *queryTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer logSlowQuery(time.Now(), query)
+	return tx.Tx.ExecContext(ctx, query, args...)
+}
+
+func (tx *queryTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	defer logSlowQuery(time.Now(), query)
+	return tx.Tx.QueryContext(ctx, query, args...)
+}
+
+func (tx *queryTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	defer logSlowQuery(time.Now(), query)
+	return tx.Tx.QueryRowContext(ctx, query, args...)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// serverTimeoutHandler は1リクエストの処理を d で打ち切ります
+// r.Context() に期限を付けるので、txScope の query は期限で中断されて transaction は rollback され、lock も解放されます
+// クライアントがタイムアウトした後も処理を続けて DB を使い続けないようにするためです
+// 期限を過ぎた後に handler が返した 5xx は 503 server_timeout に置き換えます
+func serverTimeoutHandler(d time.Duration, f http.Handler) http.Handler {
+	if d <= 0 {
+		return f
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+		tw := &timeoutWriter{ResponseWriter: w, r: r}
+		f.ServeHTTP(tw, r)
+		if !tw.wrote && ctx.Err() == context.DeadlineExceeded {
+			tw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
+
+type timeoutWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	wrote    bool
+	timedOut bool
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	if code >= 500 && w.r.Context().Err() == context.DeadlineExceeded {
+		w.timedOut = true
+		logf(w.r, "info", "server timeout. path: %s", w.r.URL.Path)
+		ErrorWithCode(w.ResponseWriter, "server timeout", "server_timeout", http.StatusServiceUnavailable)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timedOut {
+		// 置き換えたので handler のエラーの body は捨てる
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -22,11 +22,22 @@ CREATE TABLE credit (
 CREATE TABLE reserve (
     id BIGINT NOT NULL AUTO_INCREMENT,
     user_id BIGINT NOT NULL,
+    app_id VARBINARY(191) NOT NULL DEFAULT '',
     amount BIGINT NOT NULL,
     note VARCHAR(255) NOT NULL,
     is_minus TINYINT(1) NOT NULL,
     created_at DATETIME(6) NOT NULL,
     expire_at DATETIME NOT NULL,
     PRIMARY KEY (id),
-    INDEX user_id_is_minus_expire_at_amount_idx (user_id, is_minus, expire_at, amount)
+    INDEX user_id_is_minus_expire_at_amount_idx (user_id, is_minus, expire_at, amount),
+    INDEX app_id_expire_at_idx (app_id, expire_at)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE credit_idempotency (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    idempotency_key VARBINARY(191) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY user_id_idempotency_key_idx (user_id, idempotency_key)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
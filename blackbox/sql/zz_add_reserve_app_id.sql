@@ -0,0 +1,8 @@
+use isubank;
+
+-- reserve.app_id を追加します
+-- z_isubankdata.sql.gz で reserve が作り直されるので、その後に実行されるようにしています
+-- 既存の環境ではこのファイルを直接流してください
+ALTER TABLE reserve
+    ADD COLUMN app_id VARBINARY(191) NOT NULL DEFAULT '' AFTER user_id,
+    ADD INDEX app_id_expire_at_idx (app_id, expire_at);